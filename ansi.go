@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// How ANSI escape sequences in messages are handled
+const (
+	ansiOff   = "off"   // leave messages as they are
+	ansiKeep  = "keep"  // keep colors, drop cursor movement and other control sequences
+	ansiStrip = "strip" // drop every escape sequence
+	ansiSpans = "spans" // drop every escape sequence, describing colors in spans instead
+)
+
+const escape = '\x1b'
+
+// ansiColors are the names of the eight standard colors, in SGR order.
+var ansiColors = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// ansiStyle is how a terminal would draw text. Colors are a standard color name,
+// optionally prefixed with "bright-", a 256-color palette index, or #rrggbb.
+type ansiStyle struct {
+	Fg        string `json:"fg,omitempty"`
+	Bg        string `json:"bg,omitempty"`
+	Bold      bool   `json:"bold,omitempty"`
+	Dim       bool   `json:"dim,omitempty"`
+	Italic    bool   `json:"italic,omitempty"`
+	Underline bool   `json:"underline,omitempty"`
+	Inverse   bool   `json:"inverse,omitempty"`
+	Strike    bool   `json:"strike,omitempty"`
+}
+
+// ansiSpan styles the characters of a stored message from Start up to End. Offsets
+// count characters (runes), not bytes.
+type ansiSpan struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+	ansiStyle
+}
+
+// ansiFilter handles the escape sequences in the messages of a single step. Colors
+// carry over from one line to the next, as they would in a terminal.
+type ansiFilter struct {
+	mode  string
+	style ansiStyle
+}
+
+// checkANSIMode returns an error if mode is not a known way of handling escapes.
+func checkANSIMode(mode string) error {
+	switch mode {
+	case ansiOff, ansiKeep, ansiStrip, ansiSpans:
+		return nil
+	}
+
+	return fmt.Errorf("unknown ANSI mode %q", mode)
+}
+
+// newANSIFilter returns an ansiFilter for mode, or nil if escapes are left alone.
+func newANSIFilter(mode string) *ansiFilter {
+	if mode == ansiOff || mode == "" {
+		return nil
+	}
+
+	return &ansiFilter{mode: mode}
+}
+
+// Process returns message with its escape sequences handled, and in spans mode the
+// styled parts of the result.
+func (f *ansiFilter) Process(message string) (string, []ansiSpan) {
+	if strings.IndexByte(message, escape) < 0 && (f.mode != ansiSpans || f.style == (ansiStyle{})) {
+		return message, nil
+	}
+
+	var out strings.Builder
+	var spans []ansiSpan
+	chars := 0
+
+	for i := 0; i < len(message); {
+		if message[i] != escape {
+			next := strings.IndexByte(message[i:], escape)
+			if next < 0 {
+				next = len(message) - i
+			}
+			text := message[i : i+next]
+			out.WriteString(text)
+			if f.mode == ansiSpans && f.style != (ansiStyle{}) {
+				n := utf8.RuneCountInString(text)
+				if last := len(spans) - 1; last >= 0 && spans[last].End == chars && spans[last].ansiStyle == f.style {
+					spans[last].End += n
+				} else {
+					spans = append(spans, ansiSpan{Start: chars, End: chars + n, ansiStyle: f.style})
+				}
+			}
+			chars += utf8.RuneCountInString(text)
+			i += next
+			continue
+		}
+
+		end, params, final := parseEscape(message[i:])
+		if final == 'm' {
+			f.style.apply(params)
+			if f.mode == ansiKeep {
+				out.WriteString(message[i : i+end])
+			}
+		}
+		i += end
+	}
+
+	return out.String(), spans
+}
+
+// parseEscape reads the escape sequence at the start of s, returning its length and,
+// for a control sequence, its parameters and final byte. A sequence that is cut off
+// runs to the end of s.
+func parseEscape(s string) (end int, params string, final byte) {
+	if len(s) < 2 {
+		return len(s), "", 0
+	}
+
+	switch s[1] {
+	case '[':
+		// Control sequence: parameter and intermediate bytes, then a final byte
+		for i := 2; i < len(s); i++ {
+			if s[i] >= 0x40 && s[i] <= 0x7e {
+				return i + 1, s[2:i], s[i]
+			}
+			if s[i] < 0x20 || s[i] > 0x7e {
+				// Not a valid control sequence, so only drop what we read of it
+				return i, "", 0
+			}
+		}
+		return len(s), "", 0
+	case ']', 'P', '_', '^':
+		// Operating system command or other string, ended by BEL or ESC \
+		for i := 2; i < len(s); i++ {
+			if s[i] == '\a' {
+				return i + 1, "", 0
+			}
+			if s[i] == escape && i+1 < len(s) && s[i+1] == '\\' {
+				return i + 2, "", 0
+			}
+		}
+		return len(s), "", 0
+	case '(', ')', '*', '+', '#', '%':
+		// Character set selection takes one more byte
+		if len(s) < 3 {
+			return len(s), "", 0
+		}
+		return 3, "", 0
+	}
+
+	return 2, "", 0
+}
+
+// apply updates the style with the parameters of a Select Graphic Rendition sequence.
+func (st *ansiStyle) apply(params string) {
+	codes := strings.FieldsFunc(params, func(r rune) bool { return r == ';' || r == ':' })
+	if len(params) == 0 {
+		codes = []string{"0"}
+	}
+
+	for i := 0; i < len(codes); i++ {
+		code, err := strconv.Atoi(codes[i])
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case code == 0:
+			*st = ansiStyle{}
+		case code == 1:
+			st.Bold = true
+		case code == 2:
+			st.Dim = true
+		case code == 3:
+			st.Italic = true
+		case code == 4:
+			st.Underline = true
+		case code == 7:
+			st.Inverse = true
+		case code == 9:
+			st.Strike = true
+		case code == 22:
+			st.Bold, st.Dim = false, false
+		case code == 23:
+			st.Italic = false
+		case code == 24:
+			st.Underline = false
+		case code == 27:
+			st.Inverse = false
+		case code == 29:
+			st.Strike = false
+		case code >= 30 && code <= 37:
+			st.Fg = ansiColors[code-30]
+		case code >= 90 && code <= 97:
+			st.Fg = "bright-" + ansiColors[code-90]
+		case code == 39:
+			st.Fg = ""
+		case code >= 40 && code <= 47:
+			st.Bg = ansiColors[code-40]
+		case code >= 100 && code <= 107:
+			st.Bg = "bright-" + ansiColors[code-100]
+		case code == 49:
+			st.Bg = ""
+		case code == 38 || code == 48:
+			color, n := extendedColor(codes[i+1:])
+			i += n
+			if code == 38 {
+				st.Fg = color
+			} else {
+				st.Bg = color
+			}
+		}
+	}
+}
+
+// extendedColor reads a 256-color (5;n) or 24-bit (2;r;g;b) color, returning it and
+// how many codes it used.
+func extendedColor(codes []string) (string, int) {
+	if len(codes) == 0 {
+		return "", 0
+	}
+
+	switch codes[0] {
+	case "5":
+		if len(codes) < 2 {
+			return "", len(codes)
+		}
+		return codes[1], 2
+	case "2":
+		if len(codes) < 4 {
+			return "", len(codes)
+		}
+		var rgb [3]int
+		for i := range rgb {
+			rgb[i], _ = strconv.Atoi(codes[i+1])
+		}
+		return fmt.Sprintf("#%02x%02x%02x", rgb[0]&0xff, rgb[1]&0xff, rgb[2]&0xff), 4
+	}
+
+	return "", 1
+}
+
+// plainText returns message without any escape sequences.
+func plainText(message string) string {
+	if strings.IndexByte(message, escape) < 0 {
+		return message
+	}
+
+	text, _ := (&ansiFilter{mode: ansiStrip}).Process(message)
+	return text
+}
+
+// maskPlain applies mask to the text of message without its escape sequences, so a
+// secret with escape sequences inside it is still found. If mask changes the text,
+// the masked text is returned without the escape sequences of the message.
+func maskPlain(message string, mask func(text string) string) string {
+	text := plainText(message)
+	if masked := mask(text); masked != text {
+		return masked
+	}
+
+	return message
+}
+
+// clipEscapes moves cut, an index into message, back to the start of the escape
+// sequence it would split, if any.
+func clipEscapes(message string, cut int) int {
+	for i := strings.IndexByte(message, escape); i >= 0 && i < cut; {
+		end, _, _ := parseEscape(message[i:])
+		if i+end > cut {
+			return i
+		}
+		next := strings.IndexByte(message[i+end:], escape)
+		if next < 0 {
+			break
+		}
+		i += end + next
+	}
+
+	return cut
+}
+
+// clipSpans drops the parts of spans past the first n characters of a message.
+func clipSpans(spans []ansiSpan, n int) []ansiSpan {
+	var clipped []ansiSpan
+	for _, s := range spans {
+		if s.Start >= n {
+			break
+		}
+		if s.End > n {
+			s.End = n
+		}
+		clipped = append(clipped, s)
+	}
+
+	return clipped
+}
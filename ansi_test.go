@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestANSIModes(t *testing.T) {
+	message := "\x1b[2K\x1b[1;31mFAIL\x1b[0m tests\x1b[3A \x1b]8;;http://x\x07link\x1b]8;;\x07"
+
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{ansiKeep, "\x1b[1;31mFAIL\x1b[0m tests link"},
+		{ansiStrip, "FAIL tests link"},
+		{ansiSpans, "FAIL tests link"},
+	}
+
+	for _, tt := range tests {
+		got, _ := newANSIFilter(tt.mode).Process(message)
+		if got != tt.want {
+			t.Errorf("Process(%q) in %s mode = %q, want %q", message, tt.mode, got, tt.want)
+		}
+	}
+
+	if f := newANSIFilter(ansiOff); f != nil {
+		t.Errorf("There should be no filter when ANSI handling is off")
+	}
+	if err := checkANSIMode("colour"); err == nil {
+		t.Errorf("Expected an error for an unknown ANSI mode")
+	}
+}
+
+func TestANSISpans(t *testing.T) {
+	f := newANSIFilter(ansiSpans)
+
+	got, spans := f.Process("ok \x1b[1;31mbad ✗\x1b[22m still red\x1b[38;5;208;48;2;0;128;255m odd")
+	if got != "ok bad ✗ still red odd" {
+		t.Errorf("Process returned %q", got)
+	}
+	want := []ansiSpan{
+		{Start: 3, End: 8, ansiStyle: ansiStyle{Fg: "red", Bold: true}},
+		{Start: 8, End: 18, ansiStyle: ansiStyle{Fg: "red"}},
+		{Start: 18, End: 22, ansiStyle: ansiStyle{Fg: "208", Bg: "#0080ff"}},
+	}
+	if !reflect.DeepEqual(spans, want) {
+		t.Errorf("spans = %+v, want %+v", spans, want)
+	}
+
+	// The style carries on to the next line until it is reset
+	got, spans = f.Process("next\x1b[m plain")
+	want = []ansiSpan{{Start: 0, End: 4, ansiStyle: ansiStyle{Fg: "208", Bg: "#0080ff"}}}
+	if got != "next plain" || !reflect.DeepEqual(spans, want) {
+		t.Errorf("Process returned %q with spans %+v, want %q with %+v", got, spans, "next plain", want)
+	}
+
+	if _, spans = f.Process("plain"); spans != nil {
+		t.Errorf("Got spans %+v after a reset", spans)
+	}
+}
+
+func TestANSICutOffSequence(t *testing.T) {
+	for _, message := range []string{"text\x1b", "text\x1b[1;3", "text\x1b]0;title"} {
+		if got, _ := newANSIFilter(ansiStrip).Process(message); got != "text" {
+			t.Errorf("Process(%q) = %q, want %q", message, got, "text")
+		}
+	}
+}
+
+func TestClipSpans(t *testing.T) {
+	spans := []ansiSpan{{Start: 0, End: 4}, {Start: 6, End: 10}, {Start: 12, End: 14}}
+
+	want := []ansiSpan{{Start: 0, End: 4}, {Start: 6, End: 8}}
+	if got := clipSpans(spans, 8); !reflect.DeepEqual(got, want) {
+		t.Errorf("clipSpans(8) = %+v, want %+v", got, want)
+	}
+}
+
+func TestClipEscapes(t *testing.T) {
+	message := "ab\x1b[31mcd\x1b[0m"
+	for _, tt := range []struct {
+		cut  int
+		want int
+	}{
+		{1, 1},
+		{2, 2},
+		{4, 2},
+		{7, 7},
+		{8, 8},
+		{11, 9},
+		{13, 13},
+	} {
+		if got := clipEscapes(message, tt.cut); got != tt.want {
+			t.Errorf("clipEscapes(%q, %d) = %d, want %d", message, tt.cut, got, tt.want)
+		}
+	}
+}
+
+func TestMaskPlain(t *testing.T) {
+	mask := func(text string) string { return strings.Replace(text, "letmein", "***", -1) }
+
+	for _, tt := range []struct {
+		message string
+		want    string
+	}{
+		{"password letmein", "password ***"},
+		{"\x1b[1mpassword\x1b[0m is fine", "\x1b[1mpassword\x1b[0m is fine"},
+		{"password let\x1b[31mmein\x1b[0m", "password ***"},
+	} {
+		if got := maskPlain(tt.message, mask); got != tt.want {
+			t.Errorf("maskPlain(%q) = %q, want %q", tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestSaverTruncatesKeptEscapes(t *testing.T) {
+	s := newTestStepSaver()
+	s.ansi = newANSIFilter(ansiKeep)
+	s.options.maxLineSize = 6
+
+	s.WriteLog(&logLine{Time: 1, Message: "ok\x1b[31mred\x1b[0m", Step: testStepName})
+	contents, _ := s.LogFiles()[0].Contents()
+
+	var stored storedLogLine
+	if err := json.Unmarshal(contents, &stored); err != nil {
+		t.Fatalf("Unmarshaling %s: %v", contents, err)
+	}
+	if want := "ok [line truncated after 6 characters]"; stored.Message != want {
+		t.Errorf("Stored %q, want %q", stored.Message, want)
+	}
+}
+
+func TestSaverStoresSpans(t *testing.T) {
+	s := newTestStepSaver()
+	s.ansi = newANSIFilter(ansiSpans)
+
+	if err := s.WriteLog(&logLine{Time: 1, Message: "\x1b[32mok\x1b[0m done", Step: testStepName}); err != nil {
+		t.Fatalf("Unexpected error writing log: %v", err)
+	}
+	contents, err := s.LogFiles()[0].Contents()
+	if err != nil {
+		t.Fatalf("Unexpected error reading log file: %v", err)
+	}
+
+	var stored storedLogLine
+	if err := json.Unmarshal(contents, &stored); err != nil {
+		t.Fatalf("Unmarshaling %s: %v", contents, err)
+	}
+	want := storedLogLine{Time: 1, Message: "ok done", StepName: testStepName, Spans: []ansiSpan{{Start: 0, End: 2, ansiStyle: ansiStyle{Fg: "green"}}}}
+	if !reflect.DeepEqual(stored, want) {
+		t.Errorf("Stored %+v, want %+v", stored, want)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	detectOff  = "off"
+	detectMask = "mask"
+	detectFlag = "flag"
+
+	findingsFile = "findings.json"
+)
+
+var (
+	privateKeyBegin = regexp.MustCompile(`-----BEGIN ([A-Z0-9]+ )*PRIVATE KEY( BLOCK)?-----`)
+	privateKeyEnd   = regexp.MustCompile(`-----END ([A-Z0-9]+ )*PRIVATE KEY( BLOCK)?-----`)
+)
+
+// detectionRule describes a kind of credential to look for. If Pattern has a capture
+// group, the first group is the credential, otherwise the whole match is. Matches whose
+// credential has less Shannon entropy per character than MinEntropy are ignored.
+type detectionRule struct {
+	Name       string  `json:"name"`
+	Pattern    string  `json:"pattern"`
+	MinEntropy float64 `json:"minEntropy"`
+	re         *regexp.Regexp
+}
+
+// builtinRules are the credential patterns that are always checked.
+var builtinRules = []detectionRule{
+	{Name: "aws-access-key-id", Pattern: `\b((?:AKIA|ASIA)[0-9A-Z]{16})\b`},
+	{Name: "aws-secret-access-key", Pattern: `(?i)aws.{0,20}?(?:key|secret).{0,5}?[=:"'\s]\s*["']?([A-Za-z0-9/+]{40})\b`, MinEntropy: 4},
+	{Name: "bearer-token", Pattern: `(?i)\bbearer\s+([A-Za-z0-9\-._~+/]{16,}=*)`, MinEntropy: 3},
+	{Name: "url-credentials", Pattern: `\b[a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]+:([^/\s@]+)@`},
+	{Name: "generic-secret", Pattern: `(?i)\b(?:secret|token|password|passwd|api[_-]?key)\b["']?\s*[=:]\s*["']?([^\s"']{8,})`, MinEntropy: 3.5},
+}
+
+// credentialDetector looks for strings in log messages that look like credentials.
+type credentialDetector struct {
+	rules []detectionRule
+	mask  bool
+}
+
+// newCredentialDetector returns a credentialDetector with the builtin rules and any
+// rules from rulesFile, a JSON list of detectionRules. In mask mode, credentials are
+// masked; in flag mode they are only reported.
+func newCredentialDetector(mode string, rulesFile string) (*credentialDetector, error) {
+	if mode != detectMask && mode != detectFlag {
+		return nil, fmt.Errorf("unknown credential detection mode %q", mode)
+	}
+
+	rules := append([]detectionRule{}, builtinRules...)
+	if len(rulesFile) != 0 {
+		data, err := ioutil.ReadFile(rulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading detection rules %s: %v", rulesFile, err)
+		}
+
+		var custom []detectionRule
+		if err := json.Unmarshal(data, &custom); err != nil {
+			return nil, fmt.Errorf("parsing detection rules %s: %v", rulesFile, err)
+		}
+		rules = append(rules, custom...)
+	}
+
+	for i := range rules {
+		re, err := regexp.Compile(rules[i].Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("compiling detection rule %s: %v", rules[i].Name, err)
+		}
+		rules[i].re = re
+	}
+
+	return &credentialDetector{rules: rules, mask: mode == detectMask}, nil
+}
+
+// entropy returns the Shannon entropy of s in bits per character.
+func entropy(s string) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+
+	counts := map[rune]int{}
+	for _, r := range s {
+		counts[r]++
+	}
+
+	var e float64
+	n := float64(len([]rune(s)))
+	for _, c := range counts {
+		p := float64(c) / n
+		e -= p * math.Log2(p)
+	}
+
+	return e
+}
+
+// credentialFinding records a line that contained a likely credential. The
+// credential itself is never recorded.
+type credentialFinding struct {
+	Line   int    `json:"n"`
+	Time   int64  `json:"t"`
+	Rule   string `json:"rule"`
+	Masked bool   `json:"masked"`
+}
+
+// credentialScanner runs a credentialDetector over the lines of a single step and
+// collects its findings.
+type credentialScanner struct {
+	detector     *credentialDetector
+	inPrivateKey bool
+	findings     []credentialFinding
+}
+
+// Scan checks the message of line number n for credentials and returns it, masked
+// if the detector is in mask mode. Escape sequences in the message are ignored.
+func (c *credentialScanner) Scan(n int, l *logLine) string {
+	return maskPlain(l.Message, func(message string) string {
+		return c.scan(n, l, message)
+	})
+}
+
+// scan checks message, the text of line number n, for credentials.
+func (c *credentialScanner) scan(n int, l *logLine, message string) string {
+	found := func(rule string) {
+		c.findings = append(c.findings, credentialFinding{Line: n, Time: l.Time, Rule: rule, Masked: c.detector.mask})
+	}
+
+	// The lines between the start and end of a private key are all key material
+	if c.inPrivateKey {
+		if privateKeyEnd.MatchString(message) {
+			c.inPrivateKey = false
+		} else if c.detector.mask {
+			return secretPlaceholder
+		}
+		return message
+	}
+	if privateKeyBegin.MatchString(message) {
+		found("private-key")
+		masked, ended := maskPrivateKeys(message)
+		c.inPrivateKey = !ended
+		if c.detector.mask {
+			message = masked
+		}
+	}
+
+	for _, rule := range c.detector.rules {
+		message = rule.apply(message, c.detector.mask, func() { found(rule.Name) })
+	}
+
+	return message
+}
+
+// maskPrivateKeys masks the key material that follows each BEGIN marker in message,
+// up to its END marker if that is on the same line, as in a JSON-escaped key. It
+// reports whether the last key in message ended.
+func maskPrivateKeys(message string) (string, bool) {
+	var masked strings.Builder
+	for {
+		begin := privateKeyBegin.FindStringIndex(message)
+		if begin == nil {
+			masked.WriteString(message)
+			return masked.String(), true
+		}
+		masked.WriteString(message[:begin[1]])
+		message = message[begin[1]:]
+
+		end := privateKeyEnd.FindStringIndex(message)
+		if end == nil {
+			if message != "" {
+				masked.WriteString(secretPlaceholder)
+			}
+			return masked.String(), false
+		}
+		if end[0] > 0 {
+			masked.WriteString(secretPlaceholder)
+		}
+		masked.WriteString(message[end[0]:end[1]])
+		message = message[end[1]:]
+	}
+}
+
+// ScanLabel checks a label value of line number n for credentials and returns it,
+// masked if the detector is in mask mode.
+func (c *credentialScanner) ScanLabel(n int, l *logLine, value string) string {
+	found := func(rule string) {
+		c.findings = append(c.findings, credentialFinding{Line: n, Time: l.Time, Rule: rule, Masked: c.detector.mask})
+	}
+
+	if privateKeyBegin.MatchString(value) {
+		found("private-key")
+		if c.detector.mask {
+			return secretPlaceholder
+		}
+	}
+	for _, rule := range c.detector.rules {
+		value = rule.apply(value, c.detector.mask, func() { found(rule.Name) })
+	}
+
+	return value
+}
+
+// Mask returns message with every likely credential in it masked, even in flag mode.
+func (d *credentialDetector) Mask(message string) string {
+	if privateKeyBegin.MatchString(message) {
+		return secretPlaceholder
+	}
+	for _, rule := range d.rules {
+		message = rule.apply(message, true, func() {})
+	}
+
+	return message
+}
+
+// maskText returns text with the known secrets and likely credentials in it masked,
+// for text written somewhere other than the log files. Either masker may be nil.
+func maskText(secrets *secretMasker, detector *credentialDetector, text string) string {
+	return maskPlain(text, func(text string) string {
+		if secrets != nil {
+			text, _ = secrets.Mask(text)
+		}
+		if detector != nil {
+			text = detector.Mask(text)
+		}
+
+		return text
+	})
+}
+
+// apply calls found for every credential the rule finds in message, and returns the
+// message with them masked if mask is set.
+func (rule detectionRule) apply(message string, mask bool, found func()) string {
+	matches := rule.re.FindAllStringSubmatchIndex(message, -1)
+	// Mask from the end of the message so earlier indexes stay valid
+	for i := len(matches) - 1; i >= 0; i-- {
+		start, end := matches[i][0], matches[i][1]
+		if len(matches[i]) >= 4 && matches[i][2] >= 0 {
+			start, end = matches[i][2], matches[i][3]
+		}
+		if entropy(message[start:end]) < rule.MinEntropy {
+			continue
+		}
+
+		found()
+		if mask {
+			message = message[:start] + secretPlaceholder + message[end:]
+		}
+	}
+
+	return message
+}
+
+// saveFindings uploads the step's credential findings, if there are any.
+func (s *stepSaver) saveFindings() error {
+	findings := s.scanner.findings
+	if len(findings) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(struct {
+		Step     string              `json:"step"`
+		Findings []credentialFinding `json:"findings"`
+	}{s.StepName, findings})
+	if err != nil {
+		return fmt.Errorf("marshaling findings for step %s: %v", s.StepName, err)
+	}
+
+	file, err := ioutil.TempFile(s.logFolder, findingsFile)
+	if err != nil {
+		return fmt.Errorf("creating temporary file for %s findings: %v", s.StepName, err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("writing %s findings: %v", s.StepName, err)
+	}
+
+	if err := s.Uploader.Upload(path.Join(s.StepName, findingsFile), file.Name()); err != nil {
+		return fmt.Errorf("uploading %s findings: %v", s.StepName, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// unknownStep is the step that malformed lines are attributed to before any step has
+// been seen. Its lines are stored, but it is not a Screwdriver step.
+const unknownStep = "unknown"
+
+// lineDecoder turns lines from the emitter into logLines. Unless it is strict, lines
+// that are not valid JSON are kept as plain text messages of the most recent step
+// and copied to a dead-letter file, instead of aborting. Known secrets and likely
+// credentials are masked before lines are copied.
+type lineDecoder struct {
+	strict     bool
+	lastStep   string
+	malformed  int
+	deadLetter *os.File
+	secrets    *secretMasker
+	detector   *credentialDetector
+	labels     *labelPolicy
+}
+
+// newLineDecoder returns a lineDecoder. If deadLetterPath is set, malformed lines are
+// appended to that file.
+func newLineDecoder(strict bool, deadLetterPath string) (*lineDecoder, error) {
+	d := &lineDecoder{strict: strict}
+
+	if len(deadLetterPath) != 0 {
+		f, err := os.OpenFile(deadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("opening dead-letter file %s: %v", deadLetterPath, err)
+		}
+		d.deadLetter = f
+	}
+
+	return d, nil
+}
+
+// Decode parses a single line from the emitter.
+func (d *lineDecoder) Decode(line string) (*logLine, error) {
+	newLog := &logLine{}
+	err := json.Unmarshal([]byte(line), newLog)
+	if err == nil {
+		if d.labels != nil {
+			d.labels.Decode([]byte(line), newLog)
+		}
+		d.lastStep = newLog.Step
+		if newLog.Stream, err = checkStream(newLog.Stream); err != nil {
+			log.Printf("WARNING: %v in line of step %s, storing it without one", err, newLog.Step)
+		}
+		return newLog, nil
+	}
+
+	if d.strict {
+		return nil, fmt.Errorf("unmarshaling log line %s: %v", line, err)
+	}
+
+	d.malformed++
+	if d.deadLetter != nil {
+		if _, err := fmt.Fprintln(d.deadLetter, maskText(d.secrets, d.detector, line)); err != nil {
+			log.Printf("ERROR: writing to dead-letter file: %v", err)
+		}
+	}
+
+	step := d.lastStep
+	if len(step) == 0 {
+		step = unknownStep
+	}
+
+	return &logLine{
+		Time:    time.Now().UnixNano() / int64(time.Millisecond),
+		Message: line,
+		Step:    step,
+	}, nil
+}
+
+// Close closes the dead-letter file and reports how many malformed lines were seen.
+func (d *lineDecoder) Close() error {
+	if d.malformed > 0 {
+		log.Printf("Kept %d malformed log lines as plain text", d.malformed)
+	}
+
+	if d.deadLetter == nil {
+		return nil
+	}
+
+	return d.deadLetter.Close()
+}
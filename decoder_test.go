@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	d, err := newLineDecoder(false, "")
+	if err != nil {
+		t.Fatalf("Unexpected error creating decoder: %v", err)
+	}
+
+	got, err := d.Decode(`{"t":1,"m":"msg","s":"step1"}`)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding: %v", err)
+	}
+	if want := (&logLine{Time: 1, Message: "msg", Step: "step1"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode() = %v, want %v", got, want)
+	}
+	if d.malformed != 0 {
+		t.Errorf("malformed = %d, want 0", d.malformed)
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	d, _ := newLineDecoder(false, "")
+
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`{"t":1,"m":"msg","s":"step1","stream":"stderr"}`, streamStderr},
+		{`{"t":1,"m":"msg","s":"step1","stream":"STDOUT"}`, streamStdout},
+		{`{"t":1,"m":"msg","s":"step1","stream":"tty"}`, ""},
+		{`{"t":1,"m":"msg","s":"step1"}`, ""},
+	}
+
+	for _, tt := range tests {
+		got, err := d.Decode(tt.line)
+		if err != nil {
+			t.Fatalf("Unexpected error decoding %s: %v", tt.line, err)
+		}
+		if got.Stream != tt.want {
+			t.Errorf("Decode(%s) has stream %q, want %q", tt.line, got.Stream, tt.want)
+		}
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "decoder")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	deadLetterPath := filepath.Join(dir, "dead-letter")
+
+	d, err := newLineDecoder(false, deadLetterPath)
+	if err != nil {
+		t.Fatalf("Unexpected error creating decoder: %v", err)
+	}
+
+	got, _ := d.Decode("garbage")
+	if got.Step != unknownStep || got.Message != "garbage" || got.Time == 0 {
+		t.Errorf("Decode(garbage) = %v, want a plain text line for step %s", got, unknownStep)
+	}
+
+	d.Decode(`{"t":1,"m":"msg","s":"step1"}`)
+	got, _ = d.Decode(`{"t":2,"m":`)
+	d.secrets = newSecretMasker([]string{"hunter2"})
+	d.detector, _ = newCredentialDetector(detectFlag, "")
+	d.Decode(`{"m":"password hunter2 token=Zx9qLm2Wv8RtY4pK"`)
+	if got.Step != "step1" || got.Message != `{"t":2,"m":` {
+		t.Errorf("Decode() = %v, want a plain text line for step1", got)
+	}
+
+	if d.malformed != 3 {
+		t.Errorf("malformed = %d, want 3", d.malformed)
+	}
+	d.Close()
+
+	deadLetters, err := ioutil.ReadFile(deadLetterPath)
+	if err != nil {
+		t.Fatalf("Couldn't read dead-letter file: %v", err)
+	}
+	if want := "garbage\n{\"t\":2,\"m\":\n{\"m\":\"password *** token=***\"\n"; string(deadLetters) != want {
+		t.Errorf("dead-letter file = %q, want %q", deadLetters, want)
+	}
+	if info, _ := os.Stat(deadLetterPath); info.Mode().Perm() != 0600 {
+		t.Errorf("dead-letter file mode = %v, want only the owner to read it", info.Mode().Perm())
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	d, _ := newLineDecoder(true, "")
+	if _, err := d.Decode("garbage"); err == nil {
+		t.Errorf("Expected an error decoding a malformed line in strict mode")
+	}
+}
+
+func TestUnknownStepIsNotUpdated(t *testing.T) {
+	updated := false
+	api := MockAPI{updateStepLines: func(stepName string, lineCount int) error {
+		updated = true
+		return nil
+	}}
+	s := NewStepSaver(unknownStep, &mockSDUploader{}, defaultLinesPerFile, api, "/tmp", stepOptions{})
+
+	s.WriteLog(&logLine{Time: 1, Message: "garbage", Step: unknownStep})
+	if err := s.Close(); err != nil {
+		t.Fatalf("Unexpected error closing the StepSaver: %v", err)
+	}
+	if updated {
+		t.Errorf("The lines of the %s step should not be sent to Screwdriver", unknownStep)
+	}
+}
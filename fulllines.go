@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"unicode/utf8"
+)
+
+// maxFullLineUploads is how many full lines of a step may be uploading at once
+const maxFullLineUploads = 4
+
+// lineLimit returns the longest message, in bytes, that is stored without truncating.
+func (s *stepSaver) lineLimit() int {
+	if s.options.maxLineSize > 0 {
+		return s.options.maxLineSize
+	}
+
+	return maxLineSize
+}
+
+// truncateIndex returns where to cut message so it is at most limit bytes long
+// without splitting a UTF-8 character.
+func truncateIndex(message string, limit int) int {
+	if len(message) <= limit {
+		return len(message)
+	}
+
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(message[cut]) {
+		cut--
+	}
+
+	return cut
+}
+
+// fullLinePath returns the Store path of the whole of a truncated line.
+func fullLinePath(step string, line int) string {
+	return path.Join(step, "lines", fmt.Sprintf("%d.json", line))
+}
+
+// saveFullLine uploads a line before it is truncated, in the background, returning
+// the path it is uploaded to. Close waits for the uploads to finish.
+func (s *stepSaver) saveFullLine(l storedLogLine) string {
+	storePath := fullLinePath(s.StepName, l.Line)
+
+	file, err := ioutil.TempFile(s.logFolder, "fullline")
+	if err != nil {
+		log.Printf("ERROR: creating file for full line %d of step %s: %v", l.Line, s.StepName, err)
+		return ""
+	}
+	if err := json.NewEncoder(file).Encode(l); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		log.Printf("ERROR: writing full line %d of step %s: %v", l.Line, s.StepName, err)
+		return ""
+	}
+	file.Close()
+
+	if s.fullLineSlots == nil {
+		s.fullLineSlots = make(chan struct{}, maxFullLineUploads)
+	}
+	s.fullLineUploads.Add(1)
+	go func() {
+		defer s.fullLineUploads.Done()
+		defer os.Remove(file.Name())
+
+		s.fullLineSlots <- struct{}{}
+		defer func() { <-s.fullLineSlots }()
+
+		if err := s.Uploader.Upload(storePath, file.Name()); err != nil {
+			log.Printf("ERROR: uploading full line %d of step %s: %v", l.Line, s.StepName, err)
+		}
+	}()
+
+	return storePath
+}
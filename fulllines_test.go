@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTruncateIndex(t *testing.T) {
+	tests := []struct {
+		message string
+		limit   int
+		want    int
+	}{
+		{"short", 10, 5},
+		{"abcdef", 3, 3},
+		// é is two bytes, so cutting after its first byte would split it
+		{"aé", 2, 1},
+		{"aéb", 3, 3},
+		{"日本", 4, 3},
+	}
+
+	for _, tt := range tests {
+		if got := truncateIndex(tt.message, tt.limit); got != tt.want {
+			t.Errorf("truncateIndex(%q, %d) = %d, want %d", tt.message, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestWriteLogTruncateLimit(t *testing.T) {
+	s := newTestStepSaver()
+	s.options.maxLineSize = 10
+	b := bytes.Buffer{}
+	s.encoder = json.NewEncoder(&b)
+
+	s.WriteLog(&logLine{Time: 1, Message: "ééééééé", Step: "step1"})
+
+	want := `{"t":1,"m":"ééééé [line truncated after 10 characters]","n":0,"s":"step1"}` + "\n"
+	if b.String() != want {
+		t.Errorf("buffer = %s, want %s", b.String(), want)
+	}
+}
+
+func TestSaverUploadsFullLines(t *testing.T) {
+	var mutex sync.Mutex
+	uploads := map[string]string{}
+	uploader := &mockSDUploader{upload: func(storePath, filePath string) error {
+		contents, _ := ioutil.ReadFile(filePath)
+		mutex.Lock()
+		defer mutex.Unlock()
+		uploads[storePath] = string(contents)
+		return nil
+	}}
+	s := NewStepSaver(testStepName, uploader, defaultLinesPerFile, MockAPI{}, "/tmp", stepOptions{maxLineSize: 5, fullLines: true}).(*stepSaver)
+
+	s.WriteLog(&logLine{Time: 1, Message: "short", Step: testStepName})
+	s.WriteLog(&logLine{Time: 2, Message: "much too long", Step: testStepName})
+	if err := s.Close(); err != nil {
+		t.Fatalf("Unexpected error closing the StepSaver: %v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	fullPath := testStepName + "/lines/1.json"
+	if want := `{"t":2,"m":"much too long","n":1,"s":"` + testStepName + `"}` + "\n"; uploads[fullPath] != want {
+		t.Errorf("Uploaded %q to %s, want %q", uploads[fullPath], fullPath, want)
+	}
+	if _, ok := uploads[testStepName+"/lines/0.json"]; ok {
+		t.Errorf("A line that was not truncated was uploaded in full")
+	}
+
+	stored := uploads[testStepName+"/log.0"]
+	if want := `"m":"much  [line truncated after 5 characters]","n":1,"s":"` + testStepName + `","full":"` + fullPath + `"}`; !strings.Contains(stored, want) {
+		t.Errorf("Stored %s, want a line containing %s", stored, want)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Roles of a line in a multi-line event
+const (
+	eventNone = iota
+	eventHead
+	eventContinuation
+)
+
+// groupingWindow is how long a line is held back waiting for a line that continues it
+// before it is stored on its own
+const groupingWindow = 5 * time.Second
+
+// eventTag ties the lines of a multi-line event such as a stack trace together. ID
+// is the line number of the first line of the event, and Seq counts from 0 there.
+type eventTag struct {
+	ID  int `json:"id"`
+	Seq int `json:"seq"`
+}
+
+// eventRules recognize the lines of multi-line events. A line matching a start
+// pattern begins an event. A line matching a continue pattern joins the line before
+// it, and a line matching an inside pattern joins an event that has already begun.
+type eventRules struct {
+	starts    []*regexp.Regexp
+	continues []*regexp.Regexp
+	insides   []*regexp.Regexp
+}
+
+// runtimeEventRules are the built-in rules for the stack traces of common runtimes.
+var runtimeEventRules = map[string]struct {
+	starts, continues, insides []string
+}{
+	"java": {
+		continues: []string{`^\s+at \S`, `^\s*\.\.\. \d+ (more|common frames omitted)`},
+		insides:   []string{`^Caused by: `, `^\s+Suppressed: `},
+	},
+	"python": {
+		starts:  []string{`^Traceback \(most recent call last\):`},
+		insides: []string{`^\s+\S`, `^$`, `^During handling of the above exception`, `^The above exception was the direct cause`, `^[A-Za-z_][\w.]*(Error|Exception|Exit|Interrupt|Warning)\b`},
+	},
+	"go": {
+		starts:  []string{`^panic: `, `^fatal error: `},
+		insides: []string{`^\s+\S`, `^$`, `^goroutine \d+ \[`, `^\[signal `, `^[\w./*()-]+\(.*\)$`, `^exit status \d+$`},
+	},
+	"node": {
+		continues: []string{`^\s+at \S`},
+	},
+}
+
+// newEventRules compiles the rules for runtimes, a comma-separated list of built-in
+// runtimes or "all", along with custom continue patterns. It returns nil if there
+// are no rules.
+func newEventRules(runtimes string, patterns []string) (*eventRules, error) {
+	var names []string
+	for _, name := range splitList(runtimes) {
+		if name == "all" {
+			for runtime := range runtimeEventRules {
+				names = append(names, runtime)
+			}
+			continue
+		}
+		if _, ok := runtimeEventRules[name]; !ok {
+			return nil, fmt.Errorf("no event grouping rules for %q", name)
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 && len(patterns) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
+
+	compile := func(patterns []string, into *[]*regexp.Regexp) error {
+		for _, p := range patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return fmt.Errorf("bad event pattern %q: %v", p, err)
+			}
+			*into = append(*into, re)
+		}
+		return nil
+	}
+
+	r := &eventRules{}
+	for _, name := range names {
+		rules := runtimeEventRules[name]
+		if err := compile(rules.starts, &r.starts); err != nil {
+			return nil, err
+		}
+		if err := compile(rules.continues, &r.continues); err != nil {
+			return nil, err
+		}
+		if err := compile(rules.insides, &r.insides); err != nil {
+			return nil, err
+		}
+	}
+	if err := compile(patterns, &r.continues); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// matchAny returns whether message matches any of patterns.
+func matchAny(patterns []*regexp.Regexp, message string) bool {
+	for _, re := range patterns {
+		if re.MatchString(message) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupedLine is a line along with its role in a multi-line event.
+type groupedLine struct {
+	line *logLine
+	role int
+}
+
+// eventGrouper finds the multi-line events in the lines of a single step. Since a
+// line only turns out to begin an event when the next line continues it, the last
+// line is held back until the next one arrives or it is flushed. An event never
+// spans lines of different streams.
+type eventGrouper struct {
+	rules     *eventRules
+	held      *logLine
+	heldSince time.Time
+	inEvent   bool
+	stream    string
+}
+
+// Group returns the lines that are ready to write once l is added.
+func (g *eventGrouper) Group(l *logLine) []groupedLine {
+	var ready []groupedLine
+
+	if l.Stream != g.stream {
+		ready = g.Flush()
+		g.inEvent = false
+		g.stream = l.Stream
+	}
+
+	// Colored stack traces are matched by their text
+	text := plainText(l.Message)
+
+	switch {
+	case matchAny(g.rules.starts, text):
+		ready = append(ready, g.Flush()...)
+		g.inEvent = true
+		return append(ready, groupedLine{l, eventHead})
+	case matchAny(g.rules.continues, text) || g.inEvent && matchAny(g.rules.insides, text):
+		if g.held != nil {
+			ready = append(ready, groupedLine{g.held, eventHead})
+			g.held = nil
+		} else if !g.inEvent {
+			// Nothing to continue, so the line begins an event of its own
+			g.inEvent = true
+			return append(ready, groupedLine{l, eventHead})
+		}
+		g.inEvent = true
+		return append(ready, groupedLine{l, eventContinuation})
+	}
+
+	g.inEvent = false
+	ready = append(ready, g.Flush()...)
+	if len(g.rules.continues) == 0 {
+		return append(ready, groupedLine{l, eventNone})
+	}
+	g.held = l
+	g.heldSince = time.Now()
+
+	return ready
+}
+
+// Flush returns the line being held back, as a line of its own.
+func (g *eventGrouper) Flush() []groupedLine {
+	if g.held == nil {
+		return nil
+	}
+
+	held := g.held
+	g.held = nil
+
+	return []groupedLine{{held, eventNone}}
+}
+
+// FlushStale returns the line being held back if it arrived before since.
+func (g *eventGrouper) FlushStale(since time.Time) []groupedLine {
+	if g.held == nil || !g.heldSince.Before(since) {
+		return nil
+	}
+
+	return g.Flush()
+}
+
+// stringList is a flag that can be given several times.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
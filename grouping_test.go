@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// groupLines runs lines through a grouper and returns their roles in order.
+func groupLines(g *eventGrouper, messages ...string) []int {
+	var roles []int
+	for _, m := range messages {
+		for _, l := range g.Group(&logLine{Message: m}) {
+			roles = append(roles, l.role)
+		}
+	}
+	for _, l := range g.Flush() {
+		roles = append(roles, l.role)
+	}
+	return roles
+}
+
+func TestEventRules(t *testing.T) {
+	if r, err := newEventRules("", nil); r != nil || err != nil {
+		t.Errorf("newEventRules with no rules = %v, %v, want nil, nil", r, err)
+	}
+	if _, err := newEventRules("cobol", nil); err == nil {
+		t.Errorf("Expected an error for an unknown runtime")
+	}
+	if _, err := newEventRules("", []string{"("}); err == nil {
+		t.Errorf("Expected an error for a bad pattern")
+	}
+	if r, err := newEventRules("all", nil); err != nil || len(r.starts) == 0 || len(r.continues) == 0 {
+		t.Errorf("newEventRules(all) = %v, %v, want every runtime's rules", r, err)
+	}
+}
+
+func TestGroupJavaStackTrace(t *testing.T) {
+	rules, _ := newEventRules("java", nil)
+	g := &eventGrouper{rules: rules}
+
+	got := groupLines(g,
+		"Running tests",
+		`Exception in thread "main" java.lang.IllegalStateException: boom`,
+		"\tat com.example.App.run(App.java:10)",
+		"\x1b[31m\tat com.example.App.main(App.java:5)\x1b[0m",
+		"Caused by: java.io.IOException: disk full",
+		"\t... 2 more",
+		"Done",
+		"Caused by: this is not part of a trace",
+	)
+	want := []int{eventNone, eventHead, eventContinuation, eventContinuation, eventContinuation, eventContinuation, eventNone, eventNone}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Roles = %v, want %v", got, want)
+	}
+}
+
+func TestGroupPythonTraceback(t *testing.T) {
+	rules, _ := newEventRules("python", nil)
+	g := &eventGrouper{rules: rules}
+
+	got := groupLines(g,
+		"    indented output",
+		"Traceback (most recent call last):",
+		`  File "app.py", line 3, in <module>`,
+		"    main()",
+		"ValueError: bad value",
+		"next step",
+	)
+	want := []int{eventNone, eventHead, eventContinuation, eventContinuation, eventContinuation, eventNone}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Roles = %v, want %v", got, want)
+	}
+}
+
+func TestGroupCustomPattern(t *testing.T) {
+	rules, _ := newEventRules("", []string{`^\s*\|`})
+	g := &eventGrouper{rules: rules}
+
+	got := groupLines(g, "| orphan", "table:", "| a", "| b", "end")
+	want := []int{eventHead, eventHead, eventContinuation, eventContinuation, eventNone}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Roles = %v, want %v", got, want)
+	}
+}
+
+func TestSaverTagsEvents(t *testing.T) {
+	s := newTestStepSaver()
+	rules, _ := newEventRules("java", nil)
+	s.grouper = &eventGrouper{rules: rules}
+
+	for _, m := range []string{"start", "java.lang.Error: oops", "\tat A.b(A.java:1)", "\tat A.c(A.java:2)"} {
+		if err := s.WriteLog(&logLine{Time: 1, Message: m, Step: "step1"}); err != nil {
+			t.Fatalf("Unexpected error writing log: %v", err)
+		}
+	}
+	if err := s.flush(); err != nil {
+		t.Fatalf("Unexpected error flushing: %v", err)
+	}
+
+	contents, _ := s.LogFiles()[0].Contents()
+	var got []storedLogLine
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		var stored storedLogLine
+		json.Unmarshal([]byte(line), &stored)
+		got = append(got, stored)
+	}
+	if len(got) != 4 {
+		t.Fatalf("Got %d lines, want 4: %s", len(got), contents)
+	}
+
+	want := []*eventTag{nil, {ID: 1, Seq: 0}, {ID: 1, Seq: 1}, {ID: 1, Seq: 2}}
+	for i, stored := range got {
+		if stored.Line != i {
+			t.Errorf("Line %d has number %d", i, stored.Line)
+		}
+		if !reflect.DeepEqual(stored.Event, want[i]) {
+			t.Errorf("Line %d has event %+v, want %+v", i, stored.Event, want[i])
+		}
+	}
+}
+
+func TestSaverGroupsEventAcrossTick(t *testing.T) {
+	s := newTestStepSaver()
+	rules, _ := newEventRules("java", nil)
+	s.grouper = &eventGrouper{rules: rules}
+
+	s.WriteLog(&logLine{Time: 1, Message: "java.lang.Error: oops", Step: "step1"})
+	// The save ticker fires before the first frame arrives
+	if err := s.flushStale(time.Now()); err != nil {
+		t.Fatalf("Unexpected error flushing: %v", err)
+	}
+	s.WriteLog(&logLine{Time: 2, Message: "\tat A.b(A.java:1)", Step: "step1"})
+	s.flush()
+
+	contents, _ := s.LogFiles()[0].Contents()
+	var got []*eventTag
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		var stored storedLogLine
+		json.Unmarshal([]byte(line), &stored)
+		got = append(got, stored.Event)
+	}
+	if want := []*eventTag{{ID: 0, Seq: 0}, {ID: 0, Seq: 1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Events = %+v, want %+v: %s", got, want, contents)
+	}
+
+	// A line is not held back forever
+	s.WriteLog(&logLine{Time: 3, Message: "done", Step: "step1"})
+	s.flushStale(time.Now().Add(groupingWindow + time.Second))
+	if s.lineCount != 3 {
+		t.Errorf("stepSaver.lineCount = %d after the held back line went stale, want 3", s.lineCount)
+	}
+	s.LogFiles()[0].Close()
+}
+
+func TestGroupSeparatesStreams(t *testing.T) {
+	rules, _ := newEventRules("java", nil)
+	g := &eventGrouper{rules: rules}
+
+	var got []int
+	for _, l := range []*logLine{
+		{Message: "java.lang.Error: boom", Stream: streamStderr},
+		{Message: "\tat A.b(A.java:1)", Stream: streamStderr},
+		{Message: "Tests failed:", Stream: streamStdout},
+		{Message: "\tat A.c(A.java:2)", Stream: streamStderr},
+	} {
+		for _, grouped := range g.Group(l) {
+			got = append(got, grouped.role)
+		}
+	}
+	for _, grouped := range g.Flush() {
+		got = append(got, grouped.role)
+	}
+
+	want := []int{eventHead, eventContinuation, eventNone, eventHead}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Roles = %v, want %v", got, want)
+	}
+}
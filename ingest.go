@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ingestPath = "/v1/lines"
+	// maxIngestBody is the largest request body accepted, in bytes
+	maxIngestBody = 10 << 20
+	// ingestRetryAfter is how long clients are asked to wait when the queue is full, in seconds
+	ingestRetryAfter = 1
+)
+
+// ingestResponse tells a client how many lines of its request were queued. When a
+// request is turned away part way through, the client should resend the lines after
+// the first Accepted ones.
+type ingestResponse struct {
+	Accepted int    `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ingestServer accepts log lines over HTTP for processes that cannot write to the
+// emitter, and queues them with the lines from the emitter. If there is a tailHub, it
+// also streams the stored lines of each step to live tail clients.
+type ingestServer struct {
+	queue    *lineQueue
+	token    string
+	tail     *tailHub
+	labels   *labelPolicy // which extra fields of the records to keep as labels
+	server   *http.Server
+	listener net.Listener
+}
+
+// newIngestServer returns an ingestServer for addr that feeds queue and serves live
+// tails from tail, if it is not nil. Requests must carry token as a bearer token.
+func newIngestServer(addr string, token string, queue *lineQueue, tail *tailHub) (*ingestServer, error) {
+	if len(token) == 0 {
+		return nil, fmt.Errorf("no token for the HTTP ingestion endpoint")
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %v", addr, err)
+	}
+
+	s := &ingestServer{queue: queue, token: token, tail: tail, listener: listener}
+	mux := http.NewServeMux()
+	mux.HandleFunc(ingestPath, s.handleLines)
+	if tail != nil {
+		mux.HandleFunc(tailPath, s.handleTail)
+	}
+	s.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *ingestServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve handles requests until the server is closed.
+func (s *ingestServer) Serve() {
+	log.Printf("Accepting log lines on http://%s%s", s.Addr(), ingestPath)
+	if s.tail != nil {
+		log.Printf("Serving live tails on http://%s%s", s.Addr(), tailPath)
+	}
+	if err := s.server.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+		log.Printf("ERROR: serving HTTP ingestion endpoint: %v", err)
+	}
+}
+
+// Close stops the server. Live tails are ended first, so their clients are told the
+// stream is over instead of being cut off.
+func (s *ingestServer) Close() error {
+	if s.tail == nil {
+		return s.server.Close()
+	}
+
+	s.tail.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		return s.server.Close()
+	}
+
+	return nil
+}
+
+// authorized returns whether a request carries the shared token.
+func (s *ingestServer) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+
+	return strings.HasPrefix(auth, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.token)) == 1
+}
+
+// handleLines queues the NDJSON log lines in the body of a POST. If the step query
+// parameter is set, it overrides the step of every line.
+func (s *ingestServer) handleLines(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		respond(w, http.StatusMethodNotAllowed, ingestResponse{Error: "only POST is supported"})
+		return
+	}
+
+	if !s.authorized(r) {
+		respond(w, http.StatusUnauthorized, ingestResponse{Error: "missing or bad token"})
+		return
+	}
+
+	lines, err := decodeIngest(http.MaxBytesReader(w, r.Body, maxIngestBody), r.URL.Query().Get("step"), s.labels)
+	if err != nil {
+		respond(w, http.StatusBadRequest, ingestResponse{Error: err.Error()})
+		return
+	}
+
+	for i, l := range lines {
+		switch err := s.queue.TryPush(l); err {
+		case nil:
+		case errQueueFull:
+			w.Header().Set("Retry-After", fmt.Sprint(ingestRetryAfter))
+			respond(w, http.StatusTooManyRequests, ingestResponse{Accepted: i, Error: err.Error()})
+			return
+		default:
+			respond(w, http.StatusServiceUnavailable, ingestResponse{Accepted: i, Error: err.Error()})
+			return
+		}
+	}
+
+	respond(w, http.StatusAccepted, ingestResponse{Accepted: len(lines)})
+}
+
+// decodeIngest parses every line of an NDJSON body, so a bad request is rejected
+// before any of it is queued.
+func decodeIngest(body io.Reader, step string, labels *labelPolicy) ([]*logLine, error) {
+	var lines []*logLine
+
+	reader := bufio.NewReader(body)
+	line, err := readln(reader)
+	for n := 1; err == nil; n++ {
+		if len(strings.TrimSpace(line)) != 0 {
+			l := &logLine{}
+			if err := json.Unmarshal([]byte(line), l); err != nil {
+				return nil, fmt.Errorf("line %d is not valid JSON: %v", n, err)
+			}
+			if labels != nil {
+				labels.Decode([]byte(line), l)
+			}
+			if len(step) != 0 {
+				l.Step = step
+			}
+			if len(l.Step) == 0 {
+				return nil, fmt.Errorf("line %d has no step", n)
+			}
+			stream, err := checkStream(l.Stream)
+			if err != nil {
+				return nil, fmt.Errorf("line %d has an %v", n, err)
+			}
+			l.Stream = stream
+			if l.Time == 0 {
+				l.Time = time.Now().UnixNano() / int64(time.Millisecond)
+			}
+			lines = append(lines, l)
+		}
+
+		line, err = readln(reader)
+	}
+
+	if err != io.EOF {
+		return nil, fmt.Errorf("reading request body: %v", err)
+	}
+
+	return lines, nil
+}
+
+// respond writes a JSON response.
+func respond(w http.ResponseWriter, status int, body ingestResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestIngestServer(t *testing.T, capacity int) *ingestServer {
+	q, err := newLineQueue(capacity, overflowBlock, os.TempDir())
+	if err != nil {
+		t.Fatalf("Unexpected error creating queue: %v", err)
+	}
+
+	return &ingestServer{queue: q, token: "sharedtoken"}
+}
+
+func postLines(s *ingestServer, target, token, body string) (*httptest.ResponseRecorder, ingestResponse) {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	if len(token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.handleLines(w, req)
+
+	var resp ingestResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+
+	return w, resp
+}
+
+func TestIngestLines(t *testing.T) {
+	s := newTestIngestServer(t, 10)
+
+	w, resp := postLines(s, ingestPath, "sharedtoken", `{"t":1,"m":"first","s":"sidecar"}
+
+{"m":"second","s":"sidecar"}`)
+	if w.Code != http.StatusAccepted || resp.Accepted != 2 {
+		t.Fatalf("Got %d accepting %d lines, want %d accepting 2", w.Code, resp.Accepted, http.StatusAccepted)
+	}
+
+	s.queue.Close()
+	if l, _ := s.queue.Pop(); !reflect.DeepEqual(*l, logLine{Time: 1, Message: "first", Step: "sidecar"}) {
+		t.Errorf("First line = %+v, want {1 first sidecar}", l)
+	}
+	if l, _ := s.queue.Pop(); l.Message != "second" || l.Time == 0 {
+		t.Errorf("Second line = %+v, want message second with the time filled in", l)
+	}
+}
+
+func TestIngestStepOverride(t *testing.T) {
+	s := newTestIngestServer(t, 10)
+
+	w, _ := postLines(s, ingestPath+"?step=proxy", "sharedtoken", `{"t":1,"m":"a","s":"main"}
+{"t":2,"m":"b"}
+`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Got status %d, want %d", w.Code, http.StatusAccepted)
+	}
+
+	s.queue.Close()
+	for l, ok := s.queue.Pop(); ok; l, ok = s.queue.Pop() {
+		if l.Step != "proxy" {
+			t.Errorf("Line %q has step %s, want proxy", l.Message, l.Step)
+		}
+	}
+}
+
+func TestIngestRejectsBadRequests(t *testing.T) {
+	s := newTestIngestServer(t, 10)
+
+	tests := []struct {
+		name   string
+		token  string
+		body   string
+		status int
+	}{
+		{name: "no token", body: `{"t":1,"m":"a","s":"main"}`, status: http.StatusUnauthorized},
+		{name: "wrong token", token: "guess", body: `{"t":1,"m":"a","s":"main"}`, status: http.StatusUnauthorized},
+		{name: "bad json", token: "sharedtoken", body: "{\"t\":1,\"m\":\"a\",\"s\":\"main\"}\nnot json", status: http.StatusBadRequest},
+		{name: "no step", token: "sharedtoken", body: `{"t":1,"m":"a"}`, status: http.StatusBadRequest},
+		{name: "unknown stream", token: "sharedtoken", body: `{"t":1,"m":"a","s":"main","stream":"stdin"}`, status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		if w, resp := postLines(s, ingestPath, test.token, test.body); w.Code != test.status || resp.Accepted != 0 {
+			t.Errorf("%s: got %d accepting %d lines, want %d accepting none", test.name, w.Code, resp.Accepted, test.status)
+		}
+	}
+	if depth := s.queue.Stats().Depth; depth != 0 {
+		t.Errorf("%d lines from bad requests were queued", depth)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, ingestPath, nil)
+	req.Header.Set("Authorization", "Bearer sharedtoken")
+	w := httptest.NewRecorder()
+	s.handleLines(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET got status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestIngestBackpressure(t *testing.T) {
+	s := newTestIngestServer(t, 2)
+
+	w, resp := postLines(s, ingestPath, "sharedtoken", `{"t":1,"m":"a","s":"main"}
+{"t":2,"m":"b","s":"main"}
+{"t":3,"m":"c","s":"main"}
+`)
+	if w.Code != http.StatusTooManyRequests || resp.Accepted != 2 {
+		t.Errorf("Got %d accepting %d lines, want %d accepting 2", w.Code, resp.Accepted, http.StatusTooManyRequests)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "1" {
+		t.Errorf("Retry-After = %q, want 1", retry)
+	}
+
+	s.queue.Close()
+	if w, _ := postLines(s, ingestPath, "sharedtoken", `{"t":3,"m":"c","s":"main"}`); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %d after the queue closed, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestIngestServer(t *testing.T) {
+	q, _ := newLineQueue(10, overflowBlock, os.TempDir())
+
+	if _, err := newIngestServer("127.0.0.1:0", "", q, nil); err == nil {
+		t.Errorf("The endpoint should not run without a token")
+	}
+
+	s, err := newIngestServer("127.0.0.1:0", "sharedtoken", q, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from newIngestServer: %v", err)
+	}
+	go s.Serve()
+	defer s.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+s.Addr().String()+ingestPath, strings.NewReader(`{"t":1,"m":"a","s":"main"}`))
+	req.Header.Set("Authorization", "Bearer sharedtoken")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error posting lines: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted || q.Stats().Depth != 1 {
+		t.Errorf("Got status %d with %d lines queued, want %d with 1", resp.StatusCode, q.Stats().Depth, http.StatusAccepted)
+	}
+}
+
+func TestDecodeIngestLabels(t *testing.T) {
+	body := `{"t":1,"m":"first","s":"main","container":"web","attempt":2}`
+
+	lines, err := decodeIngest(strings.NewReader(body), "", newLabelPolicy("container", 16, 256))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding: %v", err)
+	}
+	if want := map[string]string{"container": "web"}; !reflect.DeepEqual(lines[0].Labels, want) {
+		t.Errorf("Labels = %v, want %v", lines[0].Labels, want)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// labelsAll keeps every extra field of the emitter records as a label.
+const labelsAll = "all"
+
+const (
+	defaultMaxLabels    = 16
+	defaultMaxLabelSize = 256
+)
+
+// labelPolicy decides which extra fields of the emitter records are kept as labels,
+// so wrappers can tag lines with things like the container or attempt they came from.
+type labelPolicy struct {
+	names   map[string]bool // the labels to keep, or nil to keep any
+	max     int             // most labels kept with a line
+	maxSize int             // longest name or value kept, in bytes
+}
+
+// newLabelPolicy returns a labelPolicy keeping the labels in names, a comma-separated
+// list or "all", or nil if no labels are kept.
+func newLabelPolicy(names string, max, maxSize int) *labelPolicy {
+	list := splitList(names)
+	if len(list) == 0 {
+		return nil
+	}
+
+	p := &labelPolicy{max: max, maxSize: maxSize}
+	for _, name := range list {
+		if name == labelsAll {
+			p.names = nil
+			break
+		}
+		if p.names == nil {
+			p.names = map[string]bool{}
+		}
+		p.names[name] = true
+	}
+
+	return p
+}
+
+// Decode sets the Labels of l from the emitter record it was decoded from. Fields
+// other than the ones logLine knows, and the fields of a labels object, are labels.
+// Strings are kept as they are and other values as JSON text. Labels past the first
+// max, and those with a name or value longer than maxSize, are dropped here, so they
+// never reach the queue.
+func (p *labelPolicy) Decode(record []byte, l *logLine) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(record, &fields) != nil {
+		return
+	}
+
+	candidates := map[string]json.RawMessage{}
+	var nested map[string]json.RawMessage
+	for key, raw := range fields {
+		switch strings.ToLower(key) {
+		case "t", "m", "s", "stream":
+		case "labels":
+			if json.Unmarshal(raw, &nested) != nil {
+				candidates[key] = raw
+			}
+		default:
+			candidates[key] = raw
+		}
+	}
+	// The labels object wins over fields of the same name
+	for name, raw := range nested {
+		candidates[name] = raw
+	}
+
+	var names []string
+	for name := range candidates {
+		if p.names == nil || p.names[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	l.Labels = nil
+	for _, name := range names {
+		value, ok := labelValue(candidates[name])
+		if !ok {
+			continue
+		}
+		if len(l.Labels) >= p.max || len(name) > p.maxSize || len(value) > p.maxSize {
+			labelsDropped.Inc()
+			continue
+		}
+		if l.Labels == nil {
+			l.Labels = map[string]string{}
+		}
+		l.Labels[name] = value
+	}
+}
+
+// labelValue returns the value of a label, or false if it is null.
+func labelValue(raw json.RawMessage) (string, bool) {
+	if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		return "", false
+	}
+
+	var value string
+	if json.Unmarshal(raw, &value) == nil {
+		return value, true
+	}
+
+	var compact bytes.Buffer
+	if json.Compact(&compact, raw) != nil {
+		return "", false
+	}
+	return compact.String(), true
+}
+
+// labels returns the labels of a line to store. Secrets and likely credentials are
+// masked in the whole of each value before it is cut to the size limit, since
+// masking can make a value longer.
+func (s *stepSaver) labels(l *logLine) map[string]string {
+	var names []string
+	for name := range l.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	labels := make(map[string]string, len(names))
+	for _, name := range names {
+		value := l.Labels[name]
+		if s.options.secrets != nil {
+			value, _ = s.options.secrets.Mask(value)
+		}
+		if s.scanner != nil {
+			value = s.scanner.ScanLabel(s.lineCount, l, value)
+		}
+		if len(value) > s.options.labels.maxSize {
+			value = value[:truncateIndex(value, s.options.labels.maxSize)]
+		}
+		labels[name] = value
+	}
+
+	return labels
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLabelPolicyDecode(t *testing.T) {
+	p := newLabelPolicy(labelsAll, 16, 256)
+
+	tests := []struct {
+		record string
+		want   map[string]string
+	}{
+		{`{"t":1,"m":"msg","s":"main"}`, nil},
+		{
+			`{"t":1,"m":"msg","s":"main","stream":"stderr","container":"web","attempt":2,"retry":true,"meta":{"a": [1, 2]},"none":null}`,
+			map[string]string{"container": "web", "attempt": "2", "retry": "true", "meta": `{"a":[1,2]}`},
+		},
+		{
+			`{"t":1,"m":"msg","s":"main","labels":{"phase":"test","container":"db"},"container":"web"}`,
+			map[string]string{"phase": "test", "container": "db"},
+		},
+		{`{"t":1,"m":"msg","s":"main","labels":"flat"}`, map[string]string{"labels": "flat"}},
+	}
+
+	for _, tt := range tests {
+		var l logLine
+		p.Decode([]byte(tt.record), &l)
+		if !reflect.DeepEqual(l.Labels, tt.want) {
+			t.Errorf("Decode(%s) = %v, want %v", tt.record, l.Labels, tt.want)
+		}
+	}
+}
+
+func TestLabelPolicyLimits(t *testing.T) {
+	if p := newLabelPolicy("", 1, 1); p != nil {
+		t.Errorf("newLabelPolicy with no labels = %+v, want nil", p)
+	}
+
+	record := []byte(`{"m":"msg","attempt":2,"container":"web","phase":"much too long","other":"x","long-label-name":"x"}`)
+
+	var l logLine
+	newLabelPolicy("container, phase,attempt,long-label-name", 16, 10).Decode(record, &l)
+	if want := map[string]string{"attempt": "2", "container": "web"}; !reflect.DeepEqual(l.Labels, want) {
+		t.Errorf("Decode() = %v, want %v", l.Labels, want)
+	}
+
+	newLabelPolicy(labelsAll, 2, 256).Decode(record, &l)
+	if want := map[string]string{"attempt": "2", "container": "web"}; !reflect.DeepEqual(l.Labels, want) {
+		t.Errorf("Decode() = %v, want %v", l.Labels, want)
+	}
+}
+
+func TestDecodeLabelsOnlyWithPolicy(t *testing.T) {
+	record := `{"t":1,"m":"msg","s":"main","container":"web","labels":{"phase":"test"}}`
+
+	d, _ := newLineDecoder(false, "")
+	l, err := d.Decode(record)
+	if err != nil || l.Labels != nil {
+		t.Errorf("Decode() without a label policy = %v, %v, want no labels", l.Labels, err)
+	}
+
+	d.labels = newLabelPolicy("phase", 16, 256)
+	l, err = d.Decode(record)
+	if want := map[string]string{"phase": "test"}; err != nil || !reflect.DeepEqual(l.Labels, want) {
+		t.Errorf("Decode() = %v, %v, want %v", l.Labels, err, want)
+	}
+}
+
+func TestLabelsSurviveSpill(t *testing.T) {
+	q, _ := newLineQueue(1, overflowSpill, os.TempDir())
+	defer q.Remove()
+
+	want := &logLine{Time: 2, Message: "spilled", Step: "main", Labels: map[string]string{"container": "web"}}
+	q.Push(&logLine{Time: 1, Message: "held", Step: "main"})
+	q.Push(want)
+	q.Close()
+
+	q.Pop()
+	if got, _ := q.Pop(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v back from the spill file, want %+v", got, want)
+	}
+}
+
+func TestSaverStoresLabels(t *testing.T) {
+	s := newTestStepSaver()
+	s.options.labels = newLabelPolicy(labelsAll, 16, 12)
+	s.options.secrets = newSecretMasker([]string{"letmein"})
+	detector, _ := newCredentialDetector(detectFlag, "")
+	s.scanner = &credentialScanner{detector: detector}
+
+	labels := map[string]string{
+		"container": "web",
+		// The secret crosses the size limit, so it has to be masked before the cut
+		"token": "abcdefghletmein",
+		"auth":  "Bearer Zx9qLm2Wv8RtY4pKf",
+	}
+	s.WriteLog(&logLine{Time: 1, Message: "msg", Step: testStepName, Labels: labels})
+	s.WriteLog(&logLine{Time: 2, Message: "plain", Step: testStepName})
+	if err := s.flush(); err != nil {
+		t.Fatalf("Unexpected error flushing: %v", err)
+	}
+
+	contents, _ := s.LogFiles()[0].Contents()
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	var stored storedLogLine
+	json.Unmarshal([]byte(lines[0]), &stored)
+	want := map[string]string{"container": "web", "token": "abcdefgh***", "auth": "Bearer Zx9qL"}
+	if !reflect.DeepEqual(stored.Labels, want) {
+		t.Errorf("Stored labels %v, want %v", stored.Labels, want)
+	}
+	if !strings.HasSuffix(lines[1], `"m":"plain","n":1,"s":"`+testStepName+`"}`) {
+		t.Errorf("A line without labels was stored as %s", lines[1])
+	}
+
+	if len(s.scanner.findings) != 1 || s.scanner.findings[0].Rule != "bearer-token" || s.scanner.findings[0].Line != 0 {
+		t.Errorf("Findings = %+v, want the bearer token in the labels of line 0", s.scanner.findings)
+	}
+}
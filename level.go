@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Levels of stored lines
+const (
+	levelError = "error"
+	levelWarn  = "warn"
+	levelInfo  = "info"
+	levelDebug = "debug"
+)
+
+// levelNames maps the ways tools spell levels to the levels we store.
+var levelNames = map[string]string{
+	"fatal":    levelError,
+	"panic":    levelError,
+	"critical": levelError,
+	"crit":     levelError,
+	"severe":   levelError,
+	"error":    levelError,
+	"err":      levelError,
+	"warning":  levelWarn,
+	"warn":     levelWarn,
+	"notice":   levelInfo,
+	"info":     levelInfo,
+	"debug":    levelDebug,
+	"trace":    levelDebug,
+}
+
+var (
+	// logfmt style, like level=warn or severity="ERROR"
+	levelField = regexp.MustCompile(`(?i)(?:^|\s)(?:level|lvl|severity)=("?)([a-z]+)\b`)
+	// bracketed, like [error] or [WARN]
+	levelBracket = regexp.MustCompile(`(?i)\[(fatal|panic|critical|crit|severe|error|err|warning|warn|notice|info|debug|trace)\]`)
+	// shouted, like ERROR or WARNING
+	levelWord = regexp.MustCompile(`\b(FATAL|PANIC|CRITICAL|SEVERE|ERROR|WARNING|WARN|NOTICE|INFO|DEBUG|TRACE)\b`)
+	// compiler style prefixes, like "error: " or "npm ERR!"
+	levelPrefix = regexp.MustCompile(`(?i)^(?:npm (err)!|(fatal|error|warning)(?:\[\w+\])?:)`)
+)
+
+// jsonLevelKeys are the keys that hold the level of a line logged as JSON.
+var jsonLevelKeys = []string{"level", "lvl", "severity", "log.level"}
+
+// levelOf returns the level of a message, or "" if it cannot tell from the message.
+func levelOf(message string) string {
+	text := strings.TrimSpace(plainText(message))
+
+	if strings.HasPrefix(text, "{") {
+		if level := jsonLevel(text); len(level) != 0 {
+			return level
+		}
+	}
+
+	if m := levelPrefix.FindStringSubmatch(text); m != nil {
+		return levelNames[strings.ToLower(m[1]+m[2])]
+	}
+	if m := levelField.FindStringSubmatch(text); m != nil {
+		if level, ok := levelNames[strings.ToLower(m[2])]; ok {
+			return level
+		}
+	}
+	if m := levelBracket.FindStringSubmatch(text); m != nil {
+		return levelNames[strings.ToLower(m[1])]
+	}
+	if m := levelWord.FindStringSubmatch(text); m != nil {
+		return levelNames[strings.ToLower(m[1])]
+	}
+
+	return ""
+}
+
+// jsonLevel returns the level of a message that is a JSON object. Numeric levels are
+// those of bunyan and pino.
+func jsonLevel(text string) string {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &fields); err != nil {
+		return ""
+	}
+
+	for _, key := range jsonLevelKeys {
+		switch v := fields[key].(type) {
+		case string:
+			if level, ok := levelNames[strings.ToLower(v)]; ok {
+				return level
+			}
+		case float64:
+			switch {
+			case v >= 50:
+				return levelError
+			case v >= 40:
+				return levelWarn
+			case v >= 30:
+				return levelInfo
+			case v > 0:
+				return levelDebug
+			}
+		}
+	}
+
+	return ""
+}
+
+// lineCounts counts the lines of a step by a property of theirs, like their level.
+type lineCounts map[string]int
+
+// add counts a line with the property key, returning the counts.
+func (c lineCounts) add(key string) lineCounts {
+	if c == nil {
+		c = lineCounts{}
+	}
+	c[key]++
+
+	return c
+}
+
+// String lists the counts in order of key, like "error=2 warn=1".
+func (c lineCounts) String() string {
+	var counts []string
+	for level, n := range c {
+		counts = append(counts, fmt.Sprintf("%s=%d", level, n))
+	}
+	sort.Strings(counts)
+
+	return strings.Join(counts, " ")
+}
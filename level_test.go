@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLevelOf(t *testing.T) {
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{`{"level":"warning","msg":"disk almost full"}`, levelWarn},
+		{`{"severity":"ERROR","message":"boom"}`, levelError},
+		{`{"level":50,"msg":"bunyan error"}`, levelError},
+		{`{"level":30,"msg":"pino info"}`, levelInfo},
+		{`{"msg":"no level"}`, ""},
+		{`time=2024-01-01 level=debug msg="starting"`, levelDebug},
+		{`level="ERROR" msg="quoted"`, levelError},
+		{`[error] could not connect`, levelError},
+		{`2024/01/01 [WARN] retrying`, levelWarn},
+		{`12:00:00 ERROR Something failed`, levelError},
+		{`12:00:00 INFO Starting server`, levelInfo},
+		{`FATAL: out of memory`, levelError},
+		{`error: could not compile`, levelError},
+		{`error[E0308]: mismatched types`, levelError},
+		{`warning: unused variable`, levelWarn},
+		{`npm ERR! code ENOENT`, levelError},
+		{"\x1b[31mERROR\x1b[0m colored", levelError},
+		{`0 errors, 0 warnings`, ""},
+		{`Error handling is fine`, ""},
+		{`the level=high is not a level`, ""},
+		{`just a line`, ""},
+	}
+
+	for _, tt := range tests {
+		if got := levelOf(tt.message); got != tt.want {
+			t.Errorf("levelOf(%q) = %q, want %q", tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestSaverDetectsLevels(t *testing.T) {
+	s := newTestStepSaver()
+	s.options.levels = true
+
+	s.WriteLog(&logLine{Time: 1, Message: "INFO starting", Step: testStepName})
+	s.WriteLog(&logLine{Time: 2, Message: "ERROR failed", Step: testStepName})
+	s.WriteLog(&logLine{Time: 3, Message: "plain", Step: testStepName})
+	s.WriteLog(&logLine{Time: 4, Message: "[error] failed again", Step: testStepName})
+	if err := s.flush(); err != nil {
+		t.Fatalf("Unexpected error flushing: %v", err)
+	}
+
+	contents, _ := s.LogFiles()[0].Contents()
+	for _, want := range []string{
+		`"m":"INFO starting","n":0,"s":"` + testStepName + `","level":"info"}`,
+		`"m":"ERROR failed","n":1,"s":"` + testStepName + `","level":"error"}`,
+		`"m":"plain","n":2,"s":"` + testStepName + `"}`,
+	} {
+		if !strings.Contains(string(contents), want) {
+			t.Errorf("Stored lines %s should contain %s", contents, want)
+		}
+	}
+
+	if got := s.levels.String(); got != "error=2 info=1" {
+		t.Errorf("Got level counts %q, want %q", got, "error=2 info=1")
+	}
+}
+
+func TestSaverLevelOfStderr(t *testing.T) {
+	s := newTestStepSaver()
+	s.options.levels = true
+
+	s.WriteLog(&logLine{Time: 1, Message: "compiling", Step: testStepName, Stream: streamStderr})
+	s.WriteLog(&logLine{Time: 2, Message: "ERROR failed", Step: testStepName, Stream: streamStderr})
+	s.WriteLog(&logLine{Time: 3, Message: "compiled", Step: testStepName, Stream: streamStdout})
+	if err := s.flush(); err != nil {
+		t.Fatalf("Unexpected error flushing: %v", err)
+	}
+
+	if got := s.levels.String(); got != "error=1 warn=1" {
+		t.Errorf("Got level counts %q, want %q", got, "error=1 warn=1")
+	}
+	if got := s.streams.String(); got != "stderr=2 stdout=1" {
+		t.Errorf("Got stream counts %q, want %q", got, "stderr=2 stdout=1")
+	}
+
+	contents, _ := s.LogFiles()[0].Contents()
+	want := `"m":"compiling","n":0,"s":"` + testStepName + `","level":"warn","stream":"stderr"}`
+	if !strings.Contains(string(contents), want) {
+		t.Errorf("Stored lines %s should contain %s", contents, want)
+	}
+}
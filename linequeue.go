@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+const (
+	overflowBlock      = "block"
+	overflowDropOldest = "drop-oldest"
+	overflowSpill      = "spill"
+)
+
+var (
+	errQueueClosed = errors.New("line queue is closed")
+	errQueueFull   = errors.New("line queue is full")
+)
+
+// queueStats describes how a lineQueue has been used.
+type queueStats struct {
+	Depth    int // lines waiting, including spilled ones
+	MaxDepth int
+	Dropped  int
+	Spilled  int // lines ever written to disk
+}
+
+// lineQueue is a bounded FIFO queue of logLines between reading the emitter and
+// saving steps, so slow saving does not hold up the emitter. When it is full, Push
+// blocks, drops the oldest line, or spills lines to disk, depending on its policy.
+type lineQueue struct {
+	mutex    sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	lines    []*logLine
+	capacity int
+	policy   string
+	closed   bool
+	stats    queueStats
+
+	spillFolder string
+	spillFile   *os.File
+	spillSource *os.File
+	spillReader *bufio.Reader
+	spilled     int // lines in the spill file that have not been popped
+}
+
+// newLineQueue returns a lineQueue holding up to capacity lines in memory. Spilled
+// lines are kept in a temporary file in spillFolder.
+func newLineQueue(capacity int, policy string, spillFolder string) (*lineQueue, error) {
+	if capacity < 1 {
+		return nil, fmt.Errorf("queue size must be at least 1, got %d", capacity)
+	}
+	if policy != overflowBlock && policy != overflowDropOldest && policy != overflowSpill {
+		return nil, fmt.Errorf("unknown queue overflow policy %q", policy)
+	}
+
+	q := &lineQueue{capacity: capacity, policy: policy, spillFolder: spillFolder}
+	q.notEmpty = sync.NewCond(&q.mutex)
+	q.notFull = sync.NewCond(&q.mutex)
+
+	return q, nil
+}
+
+// Push adds a line to the end of the queue. It fails once the queue is closed.
+func (q *lineQueue) Push(l *logLine) error {
+	return q.push(l, true)
+}
+
+// TryPush is like Push, but fails with errQueueFull instead of waiting for room.
+func (q *lineQueue) TryPush(l *logLine) error {
+	return q.push(l, false)
+}
+
+func (q *lineQueue) push(l *logLine, wait bool) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for q.policy == overflowBlock && len(q.lines) >= q.capacity && !q.closed {
+		if !wait {
+			return errQueueFull
+		}
+		q.notFull.Wait()
+	}
+	if q.closed {
+		return errQueueClosed
+	}
+
+	switch {
+	case q.spilled > 0 || (q.policy == overflowSpill && len(q.lines) >= q.capacity):
+		// Once lines are spilled, newer lines have to follow them to keep their order
+		if err := q.spill(l); err != nil {
+			return err
+		}
+	case len(q.lines) >= q.capacity:
+		if q.stats.Dropped == 0 {
+			log.Printf("WARNING: log queue is full, dropping the oldest lines")
+		}
+		q.lines = q.lines[1:]
+		q.stats.Dropped++
+		queueDropped.Inc()
+		q.lines = append(q.lines, l)
+	default:
+		q.lines = append(q.lines, l)
+	}
+
+	depth := len(q.lines) + q.spilled
+	if depth > q.stats.MaxDepth {
+		q.stats.MaxDepth = depth
+	}
+	queueDepth.Set(float64(depth))
+	q.notEmpty.Signal()
+
+	return nil
+}
+
+// spilledLine is how a line is written to the spill file, along with the labels that
+// are not part of the emitter protocol.
+type spilledLine struct {
+	*logLine
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// spill writes a line to the spill file, creating it if necessary.
+func (q *lineQueue) spill(l *logLine) error {
+	if q.spillFile == nil {
+		f, err := ioutil.TempFile(q.spillFolder, "spill")
+		if err != nil {
+			return fmt.Errorf("creating spill file: %v", err)
+		}
+		r, err := os.Open(f.Name())
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return fmt.Errorf("opening spill file: %v", err)
+		}
+		log.Printf("Log queue is full, spilling lines to %s", f.Name())
+		q.spillFile = f
+		q.spillSource = r
+		q.spillReader = bufio.NewReader(r)
+	}
+
+	data, err := json.Marshal(spilledLine{l, l.Labels})
+	if err != nil {
+		return fmt.Errorf("marshaling spilled line %v: %v", l, err)
+	}
+	if _, err := q.spillFile.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("writing to spill file: %v", err)
+	}
+	q.spilled++
+	q.stats.Spilled++
+
+	return nil
+}
+
+// unspill reads the oldest spilled line back from the spill file.
+func (q *lineQueue) unspill() (*logLine, error) {
+	q.spilled--
+	data, err := readln(q.spillReader)
+	if err != nil {
+		return nil, fmt.Errorf("reading spill file: %v", err)
+	}
+
+	l := spilledLine{logLine: &logLine{}}
+	if err := json.Unmarshal([]byte(data), &l); err != nil {
+		return nil, fmt.Errorf("unmarshaling spilled line %s: %v", data, err)
+	}
+	l.logLine.Labels = l.Labels
+
+	return l.logLine, nil
+}
+
+// Pop removes and returns the line at the front of the queue, waiting for one if the
+// queue is empty. It returns false once the queue is closed and empty.
+func (q *lineQueue) Pop() (*logLine, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	defer func() { queueDepth.Set(float64(len(q.lines) + q.spilled)) }()
+
+	for {
+		for len(q.lines) == 0 && q.spilled == 0 && !q.closed {
+			q.notEmpty.Wait()
+		}
+
+		if len(q.lines) > 0 {
+			l := q.lines[0]
+			q.lines = q.lines[1:]
+			q.notFull.Signal()
+			return l, true
+		}
+
+		if q.spilled == 0 {
+			return nil, false
+		}
+
+		l, err := q.unspill()
+		if err == nil {
+			return l, true
+		}
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// Stats returns the current queue statistics.
+func (q *lineQueue) Stats() queueStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := q.stats
+	stats.Depth = len(q.lines) + q.spilled
+
+	return stats
+}
+
+// Close stops the queue from accepting lines. Lines already queued can still be popped.
+func (q *lineQueue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+// Remove deletes the spill file, if there is one.
+func (q *lineQueue) Remove() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.spillFile == nil {
+		return nil
+	}
+
+	f := q.spillFile
+	q.spillFile = nil
+	f.Close()
+	q.spillSource.Close()
+
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func pushLines(t *testing.T, q *lineQueue, n int) {
+	for i := 0; i < n; i++ {
+		if err := q.Push(&logLine{Time: int64(i), Message: fmt.Sprintf("msg %d", i), Step: testStepName}); err != nil {
+			t.Fatalf("Unexpected error pushing line %d: %v", i, err)
+		}
+	}
+}
+
+func popAll(q *lineQueue) []string {
+	var got []string
+	for l, ok := q.Pop(); ok; l, ok = q.Pop() {
+		got = append(got, l.Message)
+	}
+	return got
+}
+
+func TestLineQueueBlock(t *testing.T) {
+	q, err := newLineQueue(2, overflowBlock, os.TempDir())
+	if err != nil {
+		t.Fatalf("Unexpected error creating queue: %v", err)
+	}
+
+	pushed := make(chan struct{})
+	go func() {
+		pushLines(t, q, 3)
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatalf("Push should block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if l, _ := q.Pop(); l.Message != "msg 0" {
+		t.Errorf("Pop() = %v, want msg 0", l)
+	}
+	<-pushed
+	q.Close()
+
+	if got, want := popAll(q), []string{"msg 1", "msg 2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("popped %v, want %v", got, want)
+	}
+	if err := q.Push(&logLine{}); err != errQueueClosed {
+		t.Errorf("Push() on a closed queue = %v, want %v", err, errQueueClosed)
+	}
+	if stats := q.Stats(); stats.MaxDepth != 2 || stats.Dropped != 0 || stats.Depth != 0 {
+		t.Errorf("Stats() = %+v, want a max depth of 2", stats)
+	}
+}
+
+func TestLineQueueDropOldest(t *testing.T) {
+	q, _ := newLineQueue(2, overflowDropOldest, os.TempDir())
+	pushLines(t, q, 5)
+	q.Close()
+
+	if got, want := popAll(q), []string{"msg 3", "msg 4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("popped %v, want %v", got, want)
+	}
+	if stats := q.Stats(); stats.Dropped != 3 {
+		t.Errorf("Stats().Dropped = %d, want 3", stats.Dropped)
+	}
+}
+
+func TestLineQueueSpill(t *testing.T) {
+	q, _ := newLineQueue(2, overflowSpill, os.TempDir())
+	defer q.Remove()
+
+	pushLines(t, q, 4)
+	if stats := q.Stats(); stats.Depth != 4 || stats.Spilled != 2 {
+		t.Errorf("Stats() = %+v, want 4 lines queued and 2 spilled", stats)
+	}
+
+	// Lines pushed while earlier lines are still spilled have to come after them
+	q.Pop()
+	q.Push(&logLine{Time: 4, Message: "msg 4", Step: testStepName})
+	q.Close()
+
+	want := []string{"msg 1", "msg 2", "msg 3", "msg 4"}
+	if got := popAll(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("popped %v, want %v", got, want)
+	}
+
+	spillFile := q.spillFile.Name()
+	if err := q.Remove(); err != nil {
+		t.Errorf("Unexpected error removing the spill file: %v", err)
+	}
+	if _, err := os.Stat(spillFile); !os.IsNotExist(err) {
+		t.Errorf("Spill file %s should be removed", spillFile)
+	}
+}
+
+func TestNewLineQueueErrors(t *testing.T) {
+	if _, err := newLineQueue(0, overflowBlock, ""); err == nil {
+		t.Errorf("Expected an error for a queue size of 0")
+	}
+	if _, err := newLineQueue(1, "sometimes", ""); err == nil {
+		t.Errorf("Expected an error for an unknown overflow policy")
+	}
+}
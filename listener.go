@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lineListener accepts connections from any number of emitters over a Unix socket or a
+// localhost TCP port and merges the NDJSON lines they send into a single stream.
+// The stream ends once every emitter has disconnected and none reconnects within the
+// grace period, or if no emitter connects before the startup timeout.
+type lineListener struct {
+	listener net.Listener
+	reader   *io.PipeReader
+	writer   *io.PipeWriter
+	// writeMutex keeps lines from different connections from being interleaved
+	writeMutex sync.Mutex
+	mutex      sync.Mutex
+	active     int
+	grace      time.Duration
+	timer      *time.Timer
+	closed     bool
+}
+
+// parseListenAddress splits an address like unix:/path/to/socket or tcp:127.0.0.1:7000
+// into its network and address. TCP addresses must be on the loopback interface.
+func parseListenAddress(listen string) (string, string, error) {
+	parts := strings.SplitN(listen, ":", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return "", "", fmt.Errorf("bad listen address %q, want unix:<path> or tcp:<host>:<port>", listen)
+	}
+
+	network, address := parts[0], parts[1]
+	switch network {
+	case "unix":
+		return network, address, nil
+	case "tcp":
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return "", "", fmt.Errorf("bad listen address %q: %v", listen, err)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return "", "", fmt.Errorf("listen address %q is not on localhost", listen)
+		}
+		return network, address, nil
+	}
+
+	return "", "", fmt.Errorf("bad listen address %q, unknown network %s", listen, network)
+}
+
+// listenForLogs starts accepting emitter connections on listen.
+func listenForLogs(listen string, startupTimeout, grace time.Duration) (*lineListener, error) {
+	network, address, err := parseListenAddress(listen)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		// Clear out a socket left behind by an earlier run
+		os.Remove(address)
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %v", listen, err)
+	}
+
+	reader, writer := io.Pipe()
+	l := &lineListener{
+		listener: listener,
+		reader:   reader,
+		writer:   writer,
+		grace:    grace,
+	}
+	l.timer = time.AfterFunc(startupTimeout, func() {
+		log.Printf("No emitter connected in the first %s", startupTimeout)
+		l.stop()
+	})
+
+	go l.accept()
+
+	return l, nil
+}
+
+// Addr returns the address the listener is accepting connections on.
+func (l *lineListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Read implements io.Reader for the merged stream of lines.
+func (l *lineListener) Read(p []byte) (int, error) {
+	return l.reader.Read(p)
+}
+
+// accept handles connections until the listener is closed.
+func (l *lineListener) accept() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.mutex.Lock()
+			closed := l.closed
+			l.mutex.Unlock()
+			if !closed {
+				log.Printf("ERROR: accepting emitter connection: %v", err)
+				l.stop()
+			}
+			return
+		}
+
+		l.mutex.Lock()
+		l.active++
+		l.timer.Stop()
+		l.mutex.Unlock()
+
+		log.Printf("Emitter connected from %s", conn.RemoteAddr())
+		go l.handle(conn)
+	}
+}
+
+// handle copies whole lines from a connection into the merged stream.
+func (l *lineListener) handle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		log.Printf("Emitter disconnected from %s", conn.RemoteAddr())
+
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.active--
+		if l.active == 0 && !l.closed {
+			l.timer = time.AfterFunc(l.grace, l.stop)
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	line, err := readln(reader)
+	for err == nil || (err == io.EOF && len(line) > 0) {
+		l.writeMutex.Lock()
+		_, writeErr := l.writer.Write([]byte(line + "\n"))
+		l.writeMutex.Unlock()
+		if writeErr != nil || err != nil {
+			return
+		}
+
+		line, err = readln(reader)
+	}
+
+	if err != io.EOF {
+		log.Printf("ERROR: reading from emitter %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// stop closes the listener and ends the merged stream, unless an emitter is connected.
+func (l *lineListener) stop() {
+	l.mutex.Lock()
+	if l.active > 0 || l.closed {
+		l.mutex.Unlock()
+		return
+	}
+	l.closed = true
+	l.mutex.Unlock()
+
+	log.Println("No emitters connected, closing log listener")
+	l.listener.Close()
+
+	l.writeMutex.Lock()
+	l.writer.Close()
+	l.writeMutex.Unlock()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		listen  string
+		network string
+		address string
+		err     bool
+	}{
+		{listen: "unix:/var/run/sd/emitter.sock", network: "unix", address: "/var/run/sd/emitter.sock"},
+		{listen: "tcp:127.0.0.1:7000", network: "tcp", address: "127.0.0.1:7000"},
+		{listen: "tcp:localhost:7000", network: "tcp", address: "localhost:7000"},
+		{listen: "tcp:[::1]:7000", network: "tcp", address: "[::1]:7000"},
+		{listen: "tcp:0.0.0.0:7000", err: true},
+		{listen: "tcp:example.com:7000", err: true},
+		{listen: "tcp:7000", err: true},
+		{listen: "udp:127.0.0.1:7000", err: true},
+		{listen: "unix:", err: true},
+		{listen: "/var/run/sd/emitter.sock", err: true},
+	}
+
+	for _, test := range tests {
+		network, address, err := parseListenAddress(test.listen)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseListenAddress(%q) should fail", test.listen)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error from parseListenAddress(%q): %v", test.listen, err)
+			continue
+		}
+		if network != test.network || address != test.address {
+			t.Errorf("parseListenAddress(%q) = %s, %s, want %s, %s", test.listen, network, address, test.network, test.address)
+		}
+	}
+}
+
+// readAll reads lines from a lineListener until the stream ends.
+func readAll(l *lineListener) ([]string, error) {
+	var lines []string
+	reader := bufio.NewReader(l)
+	line, err := readln(reader)
+	for err == nil {
+		lines = append(lines, line)
+		line, err = readln(reader)
+	}
+
+	return lines, err
+}
+
+// readAllAsync reads lines from a lineListener in the background.
+func readAllAsync(l *lineListener) chan []string {
+	done := make(chan []string)
+	go func() {
+		lines, _ := readAll(l)
+		done <- lines
+	}()
+
+	return done
+}
+
+func checkLines(t *testing.T, done chan []string, want []string) {
+	select {
+	case got := <-done:
+		sort.Strings(got)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Got %d lines, want %d. Lines must not be lost or interleaved", len(got), len(want))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream did not end after all emitters disconnected")
+	}
+}
+
+func TestListenerMergesConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := listenForLogs("unix:"+filepath.Join(dir, "emitter.sock"), time.Minute, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unexpected error from listenForLogs: %v", err)
+	}
+	done := readAllAsync(l)
+
+	var want []string
+	var wg sync.WaitGroup
+	for c := 0; c < 3; c++ {
+		conn, err := net.Dial("unix", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Unexpected error connecting: %v", err)
+		}
+
+		var lines []string
+		for i := 0; i < 200; i++ {
+			lines = append(lines, fmt.Sprintf(`{"t":%d,"m":"emitter %d line %d %s","s":"step%d"}`, i, c, i, strings.Repeat("x", 500), c))
+		}
+		want = append(want, lines...)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			for _, line := range lines {
+				fmt.Fprintln(conn, line)
+			}
+		}()
+	}
+	wg.Wait()
+
+	checkLines(t, done, want)
+}
+
+func TestListenerEndsAfterGrace(t *testing.T) {
+	l, err := listenForLogs("tcp:127.0.0.1:0", time.Minute, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unexpected error from listenForLogs: %v", err)
+	}
+	done := readAllAsync(l)
+
+	var want []string
+	var conns []net.Conn
+	for c := 0; c < 2; c++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Unexpected error connecting: %v", err)
+		}
+		conns = append(conns, conn)
+		for i := 0; i < 50; i++ {
+			line := fmt.Sprintf(`{"t":%d,"m":"emitter %d line %d","s":"main"}`, i, c, i)
+			want = append(want, line)
+			fmt.Fprintln(conn, line)
+		}
+	}
+	conns[0].Close()
+
+	select {
+	case <-done:
+		t.Fatal("Stream ended while an emitter was connected")
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	// An emitter reconnecting within the grace period keeps the stream open
+	conns[1].Close()
+	time.Sleep(10 * time.Millisecond)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error reconnecting: %v", err)
+	}
+	fmt.Fprint(conn, "last line without a newline")
+	want = append(want, "last line without a newline")
+	conn.Close()
+
+	checkLines(t, done, want)
+
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Errorf("Listener should be closed once the stream ends")
+	}
+}
+
+func TestListenerStartupTimeout(t *testing.T) {
+	l, err := listenForLogs("tcp:127.0.0.1:0", 50*time.Millisecond, time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error from listenForLogs: %v", err)
+	}
+
+	lines, err := readAll(l)
+	if len(lines) != 0 || err.Error() != "EOF" {
+		t.Errorf("readAll() = %v, %v, want no lines and EOF", lines, err)
+	}
+}
@@ -1,31 +1,49 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/screwdriver-cd/log-service/sduploader"
 )
 
 // storedLogLine is a representation of logs for permanent storage in the Store
 type storedLogLine struct {
-	Time     int64  `json:"t"`
-	Message  string `json:"m"`
-	Line     int    `json:"n"`
-	StepName string `json:"s"`
+	Time     int64             `json:"t"`
+	Message  string            `json:"m"`
+	Line     int               `json:"n"`
+	StepName string            `json:"s"`
+	Spans    []ansiSpan        `json:"spans,omitempty"`
+	Full     string            `json:"full,omitempty"` // Store path of the whole line, if it was truncated
+	Event    *eventTag         `json:"event,omitempty"`
+	Level    string            `json:"level,omitempty"`
+	Stream   string            `json:"stream,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
 }
 
 type logFile struct {
 	lineCount      int
 	savedLineCount int
+	size           int64
+	savedSize      int64
 	mutex          *sync.RWMutex
 	storePath      string
 	uploader       sduploader.SDUploader
 	file           *os.File
+	hash           hash.Hash
+	info           chunkInfo
+	savedInfo      chunkInfo
 }
 
 // newLogFile returns a logFile object for saving a single file to the Store.
@@ -35,15 +53,103 @@ func newLogFile(uploader sduploader.SDUploader, logFolder string, storePath stri
 		return &logFile{}, fmt.Errorf("creating temporary file for %s: %v", storePath, err)
 	}
 
+	return openLogFile(uploader, file, storePath), nil
+}
+
+// openLogFile returns a logFile object for saving an already created, empty file to the Store.
+func openLogFile(uploader sduploader.SDUploader, file *os.File, storePath string) *logFile {
 	return &logFile{
 		mutex:     &sync.RWMutex{},
 		storePath: storePath,
 		uploader:  uploader,
 		file:      file,
-	}, nil
+		hash:      sha256.New(),
+	}
+}
+
+// restore seeds an empty logFile with the contents of a chunk that was partially
+// written by an earlier StepSaver, with saved describing how much of it was uploaded.
+// firstLine is the number of the chunk's first line.
+func (l *logFile) restore(contents []byte, saved chunkInfo, firstLine int) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, err := l.file.Write(contents); err != nil {
+		return fmt.Errorf("restoring %s: %v", l.storePath, err)
+	}
+	l.hash.Write(contents)
+	l.lineCount = bytes.Count(contents, []byte("\n"))
+	l.savedLineCount = saved.lines()
+	l.size = int64(len(contents))
+	l.savedSize = saved.Size
+
+	saved.Final = false
+	l.savedInfo = saved
+	l.info = saved
+	l.info.FirstLine = firstLine
+	l.info.LastLine = firstLine + l.lineCount - 1
+	l.info.Size = l.size
+
+	// Take the times from the lines themselves, in case the chunk was never uploaded
+	lines := bytes.Split(bytes.TrimSuffix(contents, []byte("\n")), []byte("\n"))
+	var first, last storedLogLine
+	if json.Unmarshal(lines[0], &first) == nil && json.Unmarshal(lines[len(lines)-1], &last) == nil {
+		l.info.FirstTime = first.Time
+		l.info.LastTime = last.Time
+	}
+
+	return nil
+}
+
+// uploadedLogFile returns a placeholder logFile for a chunk that an earlier StepSaver
+// already filled and uploaded. Saving and closing it are no-ops.
+func uploadedLogFile(storePath string, info chunkInfo) *logFile {
+	return &logFile{
+		mutex:     &sync.RWMutex{},
+		storePath: storePath,
+		info:      info,
+		savedInfo: info,
+	}
+}
+
+// record notes the number and time of the line that was just written, for describing
+// the logfile in the step manifest.
+func (l *logFile) record(line int, t int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.lineCount == 1 {
+		l.info.FirstLine = line
+		l.info.FirstTime = t
+	}
+	l.info.LastLine = line
+	l.info.LastTime = t
+	l.info.Size = l.size
+}
+
+// SavedInfo describes the logfile as of its last successful save.
+func (l *logFile) SavedInfo() chunkInfo {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.savedInfo
+}
+
+// Contents returns everything written to the logfile so far.
+func (l *logFile) Contents() ([]byte, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if l.file == nil {
+		return nil, nil
+	}
+
+	// Read through the open file, which stays readable even if its name is removed
+	return ioutil.ReadAll(io.NewSectionReader(l.file, 0, l.size))
 }
 
-// Save synchronously saves the logfile to the data store
+// Save synchronously saves the logfile to the data store. If the uploader can append
+// to what it uploaded before, only the bytes written since the last save are sent.
 func (l *logFile) Save() error {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
@@ -52,10 +158,28 @@ func (l *logFile) Save() error {
 		return nil
 	}
 
-	log.Println("Uploading", l.file.Name())
-	err := l.uploader.Upload(l.storePath, l.file.Name())
+	var err error
+	var stored sduploader.StoredFile
+	defer func(start time.Time) { observeUpload(start, err) }(time.Now())
+	if ru, ok := l.uploader.(sduploader.RangeUploader); ok {
+		log.Printf("Uploading %s from byte %d", l.file.Name(), l.savedSize)
+		err = ru.UploadRange(l.storePath, l.file.Name(), l.savedSize)
+	} else if su, ok := l.uploader.(sduploader.StoringUploader); ok {
+		log.Println("Uploading", l.file.Name())
+		stored, err = su.UploadStored(l.storePath, l.file.Name())
+	} else {
+		log.Println("Uploading", l.file.Name())
+		err = l.uploader.Upload(l.storePath, l.file.Name())
+	}
 	if err == nil {
 		l.savedLineCount = l.lineCount
+		l.savedSize = l.size
+		l.savedInfo = l.info
+		l.savedInfo.Size = l.size
+		l.savedInfo.Checksum = "sha256:" + hex.EncodeToString(l.hash.Sum(nil))
+		l.savedInfo.Encoding = stored.Encoding
+		l.savedInfo.StoredSize = stored.Size
+		l.savedInfo.StoredChecksum = stored.Checksum
 	}
 
 	return err
@@ -67,6 +191,8 @@ func (l *logFile) Write(p []byte) (int, error) {
 	defer l.mutex.Unlock()
 
 	n, err := l.file.Write(p)
+	l.hash.Write(p[:n])
+	l.size += int64(n)
 	if err == nil {
 		l.lineCount++
 	}
@@ -90,5 +216,24 @@ func (l *logFile) Close() error {
 
 	l.file = nil
 
-	return os.Remove(f.Name())
+	if err := os.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Release closes the underlying file handle but leaves the file on disk.
+func (l *logFile) Release() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	f := l.file
+	l.file = nil
+
+	return f.Close()
 }
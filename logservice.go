@@ -2,15 +2,15 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/signal"
+	"path"
 	"strconv"
-	"sync"
+	"strings"
 	"syscall"
 	"time"
 
@@ -28,6 +28,13 @@ const (
 	logBufferSize       = 200
 	maxLineSize         = 5000
 	defaultLogFolder    = "/sd"
+	defaultStepIdle     = 30 * time.Second
+	defaultReconnect    = 30 * time.Second
+	defaultShutdown     = 20 * time.Second
+
+	backendStore = "store"
+	backendS3    = "s3"
+	backendFile  = "file"
 )
 
 func main() {
@@ -41,15 +48,185 @@ func parseFlags() app {
 	a := app{}
 	flag.StringVar(&a.apiUrl, "api-uri", "", "Base URI for the Screwdriver API ($SD_API_URL)")
 	flag.StringVar(&a.storeUrl, "store-uri", "", "Base URI for the Screwdriver Store API ($SD_STORE_URL)")
+	flag.StringVar(&a.storeBackend, "store-backend", backendStore, "Comma-separated places to upload logs to: the Screwdriver Store, an S3-compatible bucket or the build log file (store, s3, file)")
+	flag.StringVar(&a.compression, "compression", "", "Compress uploaded log files (gzip; empty for none). The Store keeps plain log.N files and also gets log.N.gz")
+	flag.StringVar(&a.bestEffort, "best-effort-backends", "", "Comma-separated store backends whose upload failures are only logged")
+	flag.StringVar(&a.s3.Endpoint, "s3-endpoint", "", "Base URI of the S3-compatible service (defaults to AWS for the region)")
+	flag.StringVar(&a.s3.Region, "s3-region", os.Getenv("AWS_REGION"), "Region of the S3 bucket ($AWS_REGION)")
+	flag.StringVar(&a.s3.Bucket, "s3-bucket", "", "S3 bucket to upload logs to; may contain {build} and {step}")
+	flag.StringVar(&a.s3.Prefix, "s3-prefix", sduploader.DefaultS3Prefix, "Key prefix for logs in the S3 bucket; may contain {build} and {step}")
+	flag.BoolVar(&a.s3.PathStyle, "s3-path-style", false, "Put the S3 bucket in the URL path instead of the host name")
+	flag.Int64Var(&a.s3.PartSize, "s3-part-size", sduploader.DefaultS3PartSize, "Log files larger than this many bytes are sent to S3 in a multipart upload")
 	flag.StringVar(&a.emitterPath, "emitter", "/var/run/sd/emitter", "Path to the log emitter file")
+	flag.StringVar(&a.listen, "listen", "", "Accept emitter connections on unix:<path> or tcp:<localhost>:<port> instead of reading the emitter file")
+	flag.StringVar(&a.httpAddr, "http-addr", "", "Address to accept log lines on with POST /v1/lines (off when empty)")
+	flag.BoolVar(&a.liveTail, "live-tail", false, "Stream the stored lines of each step as Server-Sent Events with GET /v1/tail on -http-addr")
+	flag.IntVar(&a.tailHistory, "tail-history", defaultTailHistory, "Number of recent lines of each step kept for live tail clients that resume")
+	flag.StringVar(&a.metricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on at /metrics (off when empty)")
+	flag.StringVar(&a.httpToken, "http-token", "", "Shared token that HTTP ingestion requests must send as a bearer token ($SD_INGEST_TOKEN)")
+	flag.DurationVar(&a.reconnectGrace, "reconnect-grace", defaultReconnect, "How long to wait for an emitter to reconnect once all have disconnected, in listen mode")
 	flag.StringVar(&a.buildID, "build", "", "ID of the build that is emitting logs ($SD_BUILDID)")
 	flag.StringVar(&a.token, "token", "", "JWT for authenticating with the Store API ($SD_TOKEN)")
 	flag.IntVar(&a.linesPerFile, "lines-per-file", defaultLinesPerFile, "Max number of lines per file when uploading ($SD_LINESPERFILE)")
 	flag.BoolVar(&a.isLocal, "local-mode", false, "Build run in local mode")
 	flag.StringVar(&a.buildLogFile, "build-log-file", "", "Path to the build log file in local mode")
 	flag.StringVar(&a.buildLogFolder, "build-log-folder", defaultLogFolder, "Directory where build log files are stored")
+	flag.BoolVar(&a.storeAppend, "store-append", false, "Upload only new bytes of each log file using partial PUTs (the Store must support Content-Range)")
+	flag.BoolVar(&a.manifest, "manifest", false, "Upload a manifest.json listing the log files of each step")
+	flag.StringVar(&a.secretsFile, "secrets-file", "", "File with one secret value per line to mask in logs")
+	flag.StringVar(&a.secretEnv, "secret-env", "", "Comma-separated names of environment variables whose values are masked in logs")
+	flag.StringVar(&a.ansi, "ansi", ansiOff, "How to handle ANSI escape sequences in messages (off, keep colors only, strip, or spans to describe colors in a spans field)")
+	flag.BoolVar(&a.collapseRedraws, "collapse-redraws", false, "Store only the final state of lines redrawn with carriage returns, like progress bars")
+	flag.IntVar(&a.redrawSample, "redraw-sample", 0, "With -collapse-redraws, also store every Nth intermediate state of a redrawn line (0 for none)")
+	flag.IntVar(&a.maxLineSize, "max-line-size", maxLineSize, "Truncate messages longer than this many bytes")
+	flag.BoolVar(&a.fullLines, "full-lines", false, "Upload lines that are truncated in full as Store objects referenced from the truncated line")
+	flag.StringVar(&a.groupEvents, "group-events", "", "Tag the lines of stack traces from these runtimes as multi-line events (comma-separated: java, python, go, node, or all)")
+	flag.Var(&a.groupPatterns, "group-pattern", "Regular expression for lines that continue the line before them in a multi-line event (may be repeated)")
+	flag.BoolVar(&a.detectLevels, "detect-levels", false, "Detect the level (error, warn, info, debug) of each line and store it with the line")
+	flag.StringVar(&a.labelFields, "labels", "", "Store these extra fields of the emitter records with each line as labels (comma-separated names, or all)")
+	flag.IntVar(&a.maxLabels, "max-labels", defaultMaxLabels, "With -labels, store at most this many labels with a line")
+	flag.IntVar(&a.maxLabelSize, "max-label-size", defaultMaxLabelSize, "With -labels, drop labels whose name or value is longer than this many bytes")
+	flag.StringVar(&a.detectCredentials, "detect-credentials", detectOff, "Look for likely credentials in logs and mask them or only flag them (off, mask, flag)")
+	flag.StringVar(&a.detectionRules, "detection-rules", "", "JSON file with extra credential detection rules")
+	flag.BoolVar(&a.strictDecoding, "strict-decoding", false, "Stop processing logs at the first line that is not valid JSON")
+	flag.StringVar(&a.deadLetterFile, "dead-letter-file", "", "File to copy log lines that are not valid JSON to")
+	flag.IntVar(&a.queueSize, "queue-size", logBufferSize, "Max number of log lines held in memory waiting to be saved")
+	flag.StringVar(&a.queueOverflow, "queue-overflow", overflowBlock, "What to do when the log queue is full (block, drop-oldest, spill)")
+	flag.StringVar(&a.spoolDir, "spool-dir", "", "Directory to keep log files and an upload journal in, so a restarted log service can finish uploading them (off when empty)")
+	flag.IntVar(&a.stepMaxLines, "step-max-lines", 0, "Once a step has stored this many lines, keep only its last lines (0 for no limit)")
+	flag.Int64Var(&a.stepMaxBytes, "step-max-bytes", 0, "Once a step has stored this many bytes, keep only its last lines (0 for no limit)")
+	flag.IntVar(&a.buildMaxLines, "build-max-lines", 0, "Once the build has stored this many lines, keep only the last lines of each step (0 for no limit)")
+	flag.Int64Var(&a.buildMaxBytes, "build-max-bytes", 0, "Once the build has stored this many bytes, keep only the last lines of each step (0 for no limit)")
+	flag.IntVar(&a.quotaTail, "quota-tail-lines", defaultQuotaTail, "How many of the last lines of a step to store once it reaches a quota")
+	flag.DurationVar(&a.shutdownTimeout, "shutdown-timeout", defaultShutdown, "How long to keep saving logs after SIGINT or SIGTERM before giving up")
+	flag.BoolVar(&a.interleavedSteps, "interleaved-steps", false, "Keep steps open while other steps emit lines, instead of closing a step as soon as the next one starts (always on with -listen or -http-addr)")
+	flag.DurationVar(&a.stepIdleTimeout, "step-idle-timeout", defaultStepIdle, "With -interleaved-steps, close a step after it emits no lines for this long (0 keeps steps open until the end of the stream)")
 	flag.Parse()
 
+	if len(a.secretsFile) != 0 || len(a.secretEnv) != 0 {
+		var envNames []string
+		if len(a.secretEnv) != 0 {
+			envNames = strings.Split(a.secretEnv, ",")
+		}
+		secrets, err := loadSecrets(a.secretsFile, envNames)
+		if err != nil {
+			log.Printf("Cannot load secrets to mask: %v", err)
+			flag.Usage()
+			os.Exit(0)
+		}
+		a.secrets = newSecretMasker(secrets)
+	}
+
+	if err := checkANSIMode(a.ansi); err != nil {
+		log.Println(err)
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	if a.maxLineSize < 1 {
+		log.Printf("Bad max line size %d, must be at least 1", a.maxLineSize)
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	events, err := newEventRules(a.groupEvents, a.groupPatterns)
+	if err != nil {
+		log.Printf("Cannot group events: %v", err)
+		flag.Usage()
+		os.Exit(0)
+	}
+	a.events = events
+
+	if a.maxLabels < 1 || a.maxLabelSize < 1 {
+		log.Printf("Bad label limits %d and %d bytes, must be at least 1", a.maxLabels, a.maxLabelSize)
+		flag.Usage()
+		os.Exit(0)
+	}
+	a.labels = newLabelPolicy(a.labelFields, a.maxLabels, a.maxLabelSize)
+
+	if a.stepMaxLines < 0 || a.stepMaxBytes < 0 || a.buildMaxLines < 0 || a.buildMaxBytes < 0 || a.quotaTail < 0 {
+		log.Println("Bad log quotas, limits and tail lines must not be negative")
+		flag.Usage()
+		os.Exit(0)
+	}
+	a.buildQuota = newLogQuota("build", a.buildMaxLines, a.buildMaxBytes)
+
+	if a.redrawSample < 0 {
+		log.Printf("Bad redraw sample %d, must not be negative", a.redrawSample)
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	if a.detectCredentials != detectOff {
+		d, err := newCredentialDetector(a.detectCredentials, a.detectionRules)
+		if err != nil {
+			log.Printf("Cannot detect credentials: %v", err)
+			flag.Usage()
+			os.Exit(0)
+		}
+		a.detector = d
+	}
+
+	backends := a.backends()
+	for _, b := range backends {
+		if b != backendStore && b != backendS3 && b != backendFile {
+			log.Printf("Unknown store backend %q", b)
+			flag.Usage()
+			os.Exit(0)
+		}
+	}
+	for _, b := range a.bestEffortBackends() {
+		if !contains(backends, b) {
+			log.Printf("Best-effort backend %q is not one of the store backends", b)
+			flag.Usage()
+			os.Exit(0)
+		}
+	}
+	if len(a.bestEffortBackends()) == len(backends) {
+		log.Println("WARNING: every store backend is best-effort, failed uploads will never be retried")
+	}
+
+	if len(a.compression) != 0 {
+		if err := sduploader.CheckEncoding(a.compression); err != nil {
+			log.Printf("Cannot compress logs: %v", err)
+			flag.Usage()
+			os.Exit(0)
+		}
+	}
+
+	if len(a.listen) != 0 {
+		if _, _, err := parseListenAddress(a.listen); err != nil {
+			log.Printf("Cannot listen for emitters: %v", err)
+			flag.Usage()
+			os.Exit(0)
+		}
+	}
+
+	if len(a.httpToken) == 0 {
+		a.httpToken = os.Getenv("SD_INGEST_TOKEN")
+	}
+
+	if len(a.httpAddr) != 0 && len(a.httpToken) == 0 {
+		log.Println("No token for the HTTP ingestion endpoint specified. Refusing to accept unauthenticated lines.")
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	if a.liveTail {
+		if len(a.httpAddr) == 0 {
+			log.Println("Live tail needs an HTTP address to serve on (-http-addr).")
+			flag.Usage()
+			os.Exit(0)
+		}
+		a.tail = newTailHub(a.tailHistory)
+	}
+
+	if len(a.metricsAddr) != 0 && a.metricsAddr == a.httpAddr {
+		log.Println("The metrics and HTTP ingestion endpoints cannot share an address.")
+		flag.Usage()
+		os.Exit(0)
+	}
+
 	if len(os.Getenv("SD_LINESPERFILE")) != 0 {
 		l, err := strconv.Atoi(os.Getenv("SD_LINESPERFILE"))
 		if err != nil {
@@ -102,7 +279,34 @@ func parseFlags() app {
 		os.Exit(0)
 	}
 
-	if len(a.storeUrl) == 0 {
+	if contains(backends, backendS3) {
+		a.s3.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		a.s3.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		a.s3.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		if _, err := sduploader.NewS3Uploader(a.buildID, a.s3); err != nil {
+			log.Printf("Cannot upload to S3: %v", err)
+			flag.Usage()
+			os.Exit(0)
+		}
+	}
+
+	if contains(backends, backendFile) && len(a.buildLogFile) == 0 {
+		log.Println("No build log file specified. Cannot use the file backend.")
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	if a.storeAppend && !contains(backends, backendStore) {
+		log.Println("Not uploading to the Store, ignoring -store-append")
+		a.storeAppend = false
+	}
+
+	if a.storeAppend && len(a.compression) != 0 {
+		log.Println("Compressed log files are uploaded whole, ignoring -store-append")
+		a.storeAppend = false
+	}
+
+	if contains(backends, backendStore) && len(a.storeUrl) == 0 {
 		log.Println("No STORE API URI specified. Cannot send logs anywhere.")
 		flag.Usage()
 		os.Exit(0)
@@ -111,6 +315,27 @@ func parseFlags() app {
 	return a
 }
 
+// contains returns true if list has s.
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) != 0 {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 // App implements the main App's interface
 type App interface {
 	LogReader() io.Reader
@@ -118,27 +343,161 @@ type App interface {
 	ScrewdriverAPI() screwdriver.API
 	BuildID() string
 	StepSaver(step string) StepSaver
+	InterleavedSteps() bool
+	StepIdleTimeout() time.Duration
+	LineDecoder() *lineDecoder
+	LineQueue() *lineQueue
+	IngestServer(queue *lineQueue) *ingestServer
+	MetricsServer() *metricsServer
+	Spool() *spool
+	ShutdownTimeout() time.Duration
 }
 
 type app struct {
 	token,
 	emitterPath,
+	listen,
 	buildID,
 	apiUrl,
 	storeUrl,
 	buildLogFile string
-	linesPerFile   int
-	isLocal        bool
-	buildLogFolder string
+	linesPerFile      int
+	isLocal           bool
+	buildLogFolder    string
+	interleavedSteps  bool
+	stepIdleTimeout   time.Duration
+	storeAppend       bool
+	manifest          bool
+	secretsFile       string
+	secretEnv         string
+	secrets           *secretMasker
+	detectCredentials string
+	ansi              string
+	collapseRedraws   bool
+	redrawSample      int
+	maxLineSize       int
+	fullLines         bool
+	groupEvents       string
+	groupPatterns     stringList
+	events            *eventRules
+	detectLevels      bool
+	labelFields       string
+	maxLabels         int
+	maxLabelSize      int
+	labels            *labelPolicy
+	stepMaxLines      int
+	stepMaxBytes      int64
+	buildMaxLines     int
+	buildMaxBytes     int64
+	quotaTail         int
+	buildQuota        *logQuota
+	detectionRules    string
+	detector          *credentialDetector
+	strictDecoding    bool
+	deadLetterFile    string
+	queueSize         int
+	queueOverflow     string
+	reconnectGrace    time.Duration
+	httpAddr          string
+	httpToken         string
+	metricsAddr       string
+	liveTail          bool
+	tailHistory       int
+	tail              *tailHub
+	storeBackend      string
+	bestEffort        string
+	compression       string
+	spoolDir          string
+	shutdownTimeout   time.Duration
+	s3                sduploader.S3Config
 }
 
-// Uploader returns an Uploader object for the Screwdriver Store
+// Uploader returns an Uploader object for the Screwdriver Store, or for every store
+// backend if there are several. Uploads are compressed if compression is enabled.
 func (a app) Uploader() sduploader.SDUploader {
 	if a.isLocal {
 		return sduploader.NewLocalUploader(a.buildLogFile)
-	} else {
-		return sduploader.NewStoreUploader(a.buildID, a.storeUrl, a.token)
 	}
+
+	u := a.backendsUploader()
+	if len(a.compression) != 0 {
+		var err error
+		if u, err = sduploader.NewCompressingUploader(u, a.compression); err != nil {
+			log.Printf("Error creating compressing uploader: %v", err)
+			os.Exit(0)
+		}
+	}
+
+	return u
+}
+
+// backendsUploader returns the Uploader for the store backend, or one that fans out
+// to every store backend if there are several.
+func (a app) backendsUploader() sduploader.SDUploader {
+	backends := a.backends()
+	if len(backends) == 1 && backends[0] != backendFile {
+		return a.backendUploader(backends[0])
+	}
+
+	var destinations []sduploader.Destination
+	for _, b := range backends {
+		d := sduploader.Destination{
+			Name:     b,
+			Uploader: a.backendUploader(b),
+			Required: !contains(a.bestEffortBackends(), b),
+		}
+		if b == backendFile {
+			// The build log file is plain text, so it only gets the log lines and not
+			// manifests or other objects
+			d.Accept = isLogChunk
+		}
+		destinations = append(destinations, d)
+	}
+
+	return sduploader.NewFanOutUploader(destinations...)
+}
+
+// isLogChunk returns whether a Store path is one of the log.N files of a step.
+func isLogChunk(storePath string) bool {
+	name := path.Base(storePath)
+	if !strings.HasPrefix(name, "log.") {
+		return false
+	}
+	_, err := strconv.Atoi(strings.TrimPrefix(name, "log."))
+	return err == nil
+}
+
+// backendUploader returns the Uploader for a single store backend.
+func (a app) backendUploader(backend string) sduploader.SDUploader {
+	switch backend {
+	case backendS3:
+		u, err := sduploader.NewS3Uploader(a.buildID, a.s3)
+		if err != nil {
+			log.Printf("Error creating %s uploader: %v", backend, err)
+			os.Exit(0)
+		}
+		return u
+	case backendFile:
+		return sduploader.NewLocalUploader(a.buildLogFile)
+	}
+
+	if a.storeAppend {
+		return sduploader.NewAppendingStoreUploader(a.buildID, a.storeUrl, a.token)
+	}
+	return sduploader.NewStoreUploader(a.buildID, a.storeUrl, a.token)
+}
+
+// backends returns the store backends logs are uploaded to.
+func (a app) backends() []string {
+	if backends := splitList(a.storeBackend); len(backends) != 0 {
+		return backends
+	}
+	return []string{backendStore}
+}
+
+// bestEffortBackends returns the store backends whose failures are only logged.
+func (a app) bestEffortBackends() []string {
+	return splitList(a.bestEffort)
 }
 
 func (a app) ScrewdriverAPI() screwdriver.API {
@@ -159,6 +518,17 @@ func (a app) ScrewdriverAPI() screwdriver.API {
 
 // LogReader returns a Reader that is the log source.
 func (a app) LogReader() io.Reader {
+	if len(a.listen) != 0 {
+		l, err := listenForLogs(a.listen, startupTimeout, a.reconnectGrace)
+		if err != nil {
+			log.Printf("Failed listening for emitters: %v", err)
+			os.Exit(0)
+		}
+		log.Printf("Listening for emitters on %s", l.Addr())
+
+		return l
+	}
+
 	// If we can't open the socket in the first 10 minutes, the sender probably
 	// exited before transmitting any data. Since we are reading from
 	// a FIFO, we will block forever unless we bail. 10 minutes should be enough time
@@ -183,7 +553,134 @@ func (a app) LogReader() io.Reader {
 
 // StepSaver returns a new StepSaver object based on the app config
 func (a app) StepSaver(step string) StepSaver {
-	return NewStepSaver(step, a.Uploader(), a.linesPerFile, a.ScrewdriverAPI(), a.buildLogFolder)
+	options := stepOptions{
+		manifest: a.manifest && !a.isLocal,
+		secrets:  a.secrets,
+
+		detector:       a.detector,
+		uploadFindings: !a.isLocal,
+
+		spool: a.Spool(),
+		tail:  a.tail,
+
+		ansi:            a.ansi,
+		collapseRedraws: a.collapseRedraws,
+		redrawSample:    a.redrawSample,
+
+		maxLineSize: a.maxLineSize,
+		fullLines:   a.fullLines && !a.isLocal,
+
+		events: a.events,
+		levels: a.detectLevels,
+
+		labels: a.labels,
+
+		stepMaxLines: a.stepMaxLines,
+		stepMaxBytes: a.stepMaxBytes,
+		buildQuota:   a.buildQuota,
+		quotaTail:    a.quotaTail,
+	}
+
+	return NewStepSaver(step, a.Uploader(), a.linesPerFile, a.ScrewdriverAPI(), a.buildLogFolder, options)
+}
+
+// Spool returns the spool for log files, or nil if it is not enabled.
+func (a app) Spool() *spool {
+	if len(a.spoolDir) == 0 {
+		return nil
+	}
+
+	sp, err := newSpool(a.spoolDir, a.linesPerFile)
+	if err != nil {
+		log.Printf("Error creating spool: %v", err)
+		os.Exit(0)
+	}
+
+	return sp
+}
+
+// LineDecoder returns a lineDecoder for the lines from the log source.
+func (a app) LineDecoder() *lineDecoder {
+	d, err := newLineDecoder(a.strictDecoding, a.deadLetterFile)
+	if err != nil {
+		log.Printf("Error creating line decoder: %v", err)
+		os.Exit(0)
+	}
+	d.secrets, d.detector, d.labels = a.secrets, a.detector, a.labels
+
+	return d
+}
+
+// LineQueue returns the queue between reading and saving log lines.
+func (a app) LineQueue() *lineQueue {
+	size, overflow := a.queueSize, a.queueOverflow
+	if size == 0 {
+		size = logBufferSize
+	}
+	if len(overflow) == 0 {
+		overflow = overflowBlock
+	}
+
+	q, err := newLineQueue(size, overflow, a.buildLogFolder)
+	if err != nil {
+		log.Printf("Error creating log queue: %v", err)
+		os.Exit(0)
+	}
+
+	return q
+}
+
+// IngestServer returns the HTTP server feeding queue, or nil if it is not enabled.
+func (a app) IngestServer(queue *lineQueue) *ingestServer {
+	if len(a.httpAddr) == 0 {
+		return nil
+	}
+
+	s, err := newIngestServer(a.httpAddr, a.httpToken, queue, a.tail)
+	if err != nil {
+		log.Printf("Error creating HTTP ingestion endpoint: %v", err)
+		os.Exit(0)
+	}
+	s.labels = a.labels
+
+	return s
+}
+
+// MetricsServer returns the server for Prometheus metrics, or nil if it is not enabled.
+func (a app) MetricsServer() *metricsServer {
+	if len(a.metricsAddr) == 0 {
+		return nil
+	}
+
+	s, err := newMetricsServer(a.metricsAddr)
+	if err != nil {
+		log.Printf("Error creating metrics endpoint: %v", err)
+		os.Exit(0)
+	}
+
+	return s
+}
+
+// InterleavedSteps returns whether lines of several steps may be interleaved, so a
+// step is not closed just because another one started. Emitters connecting with
+// -listen and lines posted to -http-addr arrive at the same time as other lines, so
+// their steps are always interleaved.
+func (a app) InterleavedSteps() bool {
+	return a.interleavedSteps || len(a.listen) != 0 || len(a.httpAddr) != 0
+}
+
+// StepIdleTimeout returns how long an interleaved step may go without lines before it
+// is closed.
+func (a app) StepIdleTimeout() time.Duration {
+	if !a.InterleavedSteps() {
+		return 0
+	}
+	return a.stepIdleTimeout
+}
+
+// ShutdownTimeout returns how long to keep saving logs once asked to shut down.
+func (a app) ShutdownTimeout() time.Duration {
+	return a.shutdownTimeout
 }
 
 // BuildID returns the id of the build being processed.
@@ -199,26 +696,19 @@ func run(a App) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
+	stop := make(chan struct{})
 	go func() {
 		sig := <-sigs
 		log.Printf("Received %v signal in log service", sig)
+		close(stop)
 	}()
 
-	if err := ArchiveLogs(a); err != nil {
+	if err := ArchiveLogsUntil(a, stop); err != nil {
 		log.Printf("Error archiving logs: %v", err)
 		os.Exit(0)
 	}
 }
 
-// safeClose is for closing when we might have a nil reference.
-func safeClose(c io.Closer) error {
-	if c == nil {
-		return nil
-	}
-
-	return c.Close()
-}
-
 // Returns a single line (without the ending \n) from the input buffered reader
 // Pulled from https://stackoverflow.com/a/12206365
 func readln(r *bufio.Reader) (string, error) {
@@ -238,42 +728,190 @@ func readln(r *bufio.Reader) (string, error) {
 
 // ArchiveLogs copies log lines from src into the Screwdriver Store
 // Logs are copied to /builds/:buildId/:stepName/log.N
+// Lines from different steps may be interleaved; each step keeps its own StepSaver
+// until it goes idle or the stream ends. Lines are read into a queue so that saving
+// them never holds up the emitter. Lines posted to the HTTP ingestion endpoint join
+// the same queue until the log source ends. If there is a spool, steps left in it by
+// an earlier run are recovered first, and it is removed once everything is saved.
 func ArchiveLogs(a App) error {
+	return ArchiveLogsUntil(a, nil)
+}
+
+// ArchiveLogsUntil is ArchiveLogs that also shuts down when stop is closed. It then
+// stops reading, saves the lines it already read and closes every step. If that takes
+// longer than the App's shutdown timeout, it gives up and returns an error naming the
+// steps that were not flushed.
+func ArchiveLogsUntil(a App, stop <-chan struct{}) (err error) {
 	log.Println("Archiver started")
 	defer log.Println("Archiver stopped")
 
-	var lastStep string
-	var stepSaver StepSaver
-	var stepWaitGroup sync.WaitGroup
+	finished := make(chan struct{})
+	defer close(finished)
+	stopping := make(chan struct{})
+	deadline := make(chan struct{})
+
+	if server := a.MetricsServer(); server != nil {
+		go server.Serve()
+		defer server.Close()
+	}
+
+	spool := a.Spool()
+	registry := newStepRegistry(a.StepSaver, a.StepIdleTimeout())
+	registry.sequential = !a.InterleavedSteps()
+	// Set if the deadline passed while a line was being written
+	drainStuck := false
+	defer func() {
+		if drainStuck {
+			// The registry is still in use, and its steps were already reported
+			return
+		}
+		closeErr := closeRegistry(registry, deadline)
+		select {
+		case <-deadline:
+			if err == nil {
+				err = closeErr
+			}
+		default:
+			if closeErr != nil {
+				log.Printf("ERROR: %v", closeErr)
+			}
+		}
+		if spool != nil && closeErr == nil && err == nil {
+			if err := spool.Remove(); err != nil {
+				log.Printf("ERROR: removing spool: %v", err)
+			}
+		}
+	}()
+
+	if spool != nil {
+		recovered, err := spool.Recover(a.Uploader())
+		if err != nil {
+			return err
+		}
+		for _, r := range recovered {
+			if err := registry.Recover(r.step, r.checkpoint, r.open); err != nil {
+				log.Printf("ERROR: %v", err)
+			}
+		}
+	}
+
+	queue := a.LineQueue()
+	defer queue.Remove()
+	defer queue.Close()
+
+	go func() {
+		select {
+		case <-stop:
+		case <-finished:
+			return
+		}
+
+		timeout := a.ShutdownTimeout()
+		log.Printf("Shutting down, saving logs for up to %s", timeout)
+		close(stopping)
+		queue.Close()
+
+		select {
+		case <-time.After(timeout):
+			close(deadline)
+		case <-finished:
+		}
+	}()
+
+	if server := a.IngestServer(queue); server != nil {
+		go server.Serve()
+		defer server.Close()
+	}
+
+	readDone := make(chan error, 1)
+	go func() {
+		readDone <- readLogs(a, queue)
+		queue.Close()
+	}()
+
+	// Writing a line can block on uploads, so the deadline is enforced while waiting
+	drained := make(chan error, 1)
+	go func() {
+		drained <- drainQueue(queue, registry, deadline)
+	}()
+
+	select {
+	case err := <-drained:
+		if err != nil {
+			return err
+		}
+	case <-deadline:
+		drainStuck = true
+		return fmt.Errorf("shutdown timed out with %d log lines left unsaved before flushing steps %s", queue.Stats().Depth, strings.Join(registry.Pending(), ", "))
+	}
+
+	stats := queue.Stats()
+	log.Printf("Log queue peaked at %d lines, dropped %d and spilled %d", stats.MaxDepth, stats.Dropped, stats.Spilled)
+
+	// When shutting down, the reader may still be waiting on the log source
+	select {
+	case <-stopping:
+		return nil
+	default:
+	}
+
+	return <-readDone
+}
+
+// drainQueue writes the lines of a queue to the steps of a registry until the queue is
+// closed and empty, or deadline is closed.
+func drainQueue(queue *lineQueue, registry *stepRegistry, deadline <-chan struct{}) error {
+	for l, ok := queue.Pop(); ok; l, ok = queue.Pop() {
+		linesIngested.Inc(l.Step)
+		if err := registry.WriteLog(l); err != nil {
+			return fmt.Errorf("writing logs for step %s: %v", l.Step, err)
+		}
+
+		select {
+		case <-deadline:
+			return fmt.Errorf("shutdown timed out with %d log lines left unsaved", queue.Stats().Depth)
+		default:
+		}
+	}
+
+	return nil
+}
+
+// closeRegistry closes every step of a registry, giving up once deadline is closed.
+func closeRegistry(registry *stepRegistry, deadline <-chan struct{}) error {
+	closed := make(chan error, 1)
+	go func() {
+		closed <- registry.Close()
+	}()
+
+	select {
+	case err := <-closed:
+		return err
+	case <-deadline:
+		return fmt.Errorf("shutdown timed out before flushing steps %s", strings.Join(registry.Pending(), ", "))
+	}
+}
+
+// readLogs reads and decodes the lines from the log source of an App onto a queue
+// until the source ends.
+func readLogs(a App, queue *lineQueue) error {
 	var readErr error
 	var line string
 
+	decoder := a.LineDecoder()
+	defer decoder.Close()
+
 	reader := bufio.NewReader(a.LogReader())
 	line, readErr = readln(reader)
 
 	for readErr == nil {
-		newLog := &logLine{}
-		if err := json.Unmarshal([]byte(line), newLog); err != nil {
-			return fmt.Errorf("unmarshaling log line %s: %v", line, err)
-		}
-
-		if newLog.Step != lastStep {
-			stepWaitGroup.Add(1)
-			go func(stepSaver StepSaver, stepName string) {
-				defer stepWaitGroup.Done()
-				if err := safeClose(stepSaver); err != nil {
-					log.Printf("ERROR: step %s encountered errors on final save: %v", stepName, err)
-				}
-			}(stepSaver, lastStep)
-
-			stepSaver = a.StepSaver(newLog.Step)
-			log.Println("Starting step processing for", newLog.Step)
-
-			lastStep = newLog.Step
+		newLog, err := decoder.Decode(line)
+		if err != nil {
+			return err
 		}
 
-		if err := stepSaver.WriteLog(newLog); err != nil {
-			return fmt.Errorf("writing logs for step %s: %v", newLog.Step, err)
+		if err := queue.Push(newLog); err != nil {
+			return fmt.Errorf("queueing log line %s: %v", line, err)
 		}
 
 		line, readErr = readln(reader)
@@ -283,7 +921,5 @@ func ArchiveLogs(a App) error {
 		return fmt.Errorf("reading the line with reader %s: %v", line, readErr)
 	}
 
-	safeClose(stepSaver)
-	stepWaitGroup.Wait()
 	return nil
 }
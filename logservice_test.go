@@ -7,9 +7,16 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/screwdriver-cd/log-service/screwdriver"
 	"github.com/screwdriver-cd/log-service/sduploader"
@@ -40,9 +47,13 @@ func mockEmitter() *os.File {
 
 type mockStepSaver struct {
 	writeLog func(l *logLine) error
+	close    func() error
 }
 
 func (s mockStepSaver) Close() error {
+	if s.close != nil {
+		return s.close()
+	}
 	return nil
 }
 
@@ -70,7 +81,8 @@ func (m *mockSDUploader) Upload(path string, filePath string) error {
 }
 
 type mockScrewdriverAPI struct {
-	updateStepLines func(string, int) error
+	updateStepLines  func(string, int) error
+	updateStepCutoff func(string, screwdriver.LogCutoff) error
 }
 
 func (m *mockScrewdriverAPI) UpdateStepLines(stepName string, lineCount int) error {
@@ -80,6 +92,13 @@ func (m *mockScrewdriverAPI) UpdateStepLines(stepName string, lineCount int) err
 	return nil
 }
 
+func (m *mockScrewdriverAPI) UpdateStepCutoff(stepName string, cutoff screwdriver.LogCutoff) error {
+	if m.updateStepCutoff != nil {
+		return m.updateStepCutoff(stepName, cutoff)
+	}
+	return nil
+}
+
 func newTestApp() *mockApp {
 	return &mockApp{}
 }
@@ -101,13 +120,20 @@ func newAppFromEmitter(emitterPath string) App {
 }
 
 type mockApp struct {
-	run            func()
-	logReader      func() io.Reader
-	uploader       func() sduploader.SDUploader
-	screwdriverAPI func() screwdriver.API
-	archiveLogs    func(uploader sduploader.SDUploader, src io.Reader) error
-	stepSaver      func(step string) StepSaver
-	buildID        string
+	run             func()
+	logReader       func() io.Reader
+	uploader        func() sduploader.SDUploader
+	screwdriverAPI  func() screwdriver.API
+	archiveLogs     func(uploader sduploader.SDUploader, src io.Reader) error
+	stepSaver       func(step string) StepSaver
+	buildID         string
+	interleaved     bool
+	stepIdle        time.Duration
+	lineDecoder     func() *lineDecoder
+	ingestServer    func(queue *lineQueue) *ingestServer
+	metricsServer   func() *metricsServer
+	spool           *spool
+	shutdownTimeout time.Duration
 }
 
 func (a mockApp) Run() {
@@ -150,6 +176,49 @@ func (a mockApp) StepSaver(step string) StepSaver {
 	return &stepSaver{}
 }
 
+func (a mockApp) LineDecoder() *lineDecoder {
+	if a.lineDecoder != nil {
+		return a.lineDecoder()
+	}
+	return &lineDecoder{}
+}
+
+func (a mockApp) LineQueue() *lineQueue {
+	q, _ := newLineQueue(logBufferSize, overflowBlock, os.TempDir())
+	return q
+}
+
+func (a mockApp) IngestServer(queue *lineQueue) *ingestServer {
+	if a.ingestServer != nil {
+		return a.ingestServer(queue)
+	}
+	return nil
+}
+
+func (a mockApp) MetricsServer() *metricsServer {
+	if a.metricsServer != nil {
+		return a.metricsServer()
+	}
+
+	return nil
+}
+
+func (a mockApp) Spool() *spool {
+	return a.spool
+}
+
+func (a mockApp) ShutdownTimeout() time.Duration {
+	return a.shutdownTimeout
+}
+
+func (a mockApp) InterleavedSteps() bool {
+	return a.interleaved
+}
+
+func (a mockApp) StepIdleTimeout() time.Duration {
+	return a.stepIdle
+}
+
 func parseLogFile(input *os.File) (logMap, error) {
 	// Re-open the file so we don't need to seek to the beginning
 	input, err := os.Open(input.Name())
@@ -235,6 +304,136 @@ func TestParseFlags(t *testing.T) {
 		t.Errorf("Lines per file= %d, want %d", a.linesPerFile, mockLinesPerFile)
 	}
 
+	if a.stepIdleTimeout != defaultStepIdle {
+		t.Errorf("Step idle timeout = %s, want %s", a.stepIdleTimeout, defaultStepIdle)
+	}
+
+	if a.manifest {
+		t.Errorf("Manifests should only be uploaded with -manifest")
+	}
+}
+
+func TestAppInterleavedSteps(t *testing.T) {
+	a := app{stepIdleTimeout: defaultStepIdle}
+	if a.InterleavedSteps() || a.StepIdleTimeout() != 0 {
+		t.Errorf("Steps should run one after another unless -interleaved-steps is set")
+	}
+
+	// Several emitters write at once in listen mode
+	a.listen = "unix:/tmp/emitter.sock"
+	if !a.InterleavedSteps() || a.StepIdleTimeout() != defaultStepIdle {
+		t.Errorf("Steps should be interleaved with -listen")
+	}
+
+	// Lines posted over HTTP join those from the emitter
+	a.listen = ""
+	a.httpAddr = "127.0.0.1:0"
+	if !a.InterleavedSteps() {
+		t.Errorf("Steps should be interleaved with -http-addr")
+	}
+}
+
+func TestAppUploader(t *testing.T) {
+	a := newAppFromEmitter(mockEmitterPath).(app)
+	if _, ok := a.Uploader().(sduploader.RangeUploader); ok {
+		t.Errorf("The Store uploader should not append unless -store-append is set")
+	}
+
+	a.storeBackend = "store, file"
+	a.bestEffort = "file"
+	a.buildLogFile = "build.log"
+	if _, ok := a.Uploader().(sduploader.RangeUploader); !ok {
+		t.Errorf("Uploading to several backends should fan out to them")
+	}
+
+	a.isLocal = true
+	if _, ok := a.Uploader().(sduploader.RangeUploader); ok {
+		t.Errorf("The local uploader should skip lines it already wrote instead of appending ranges")
+	}
+}
+
+func TestAppFanOutFileGetsOnlyLogs(t *testing.T) {
+	var stored []string
+	var mutex sync.Mutex
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		stored = append(stored, r.URL.Path)
+	}))
+	defer store.Close()
+
+	dir, err := ioutil.TempDir("", "fanout")
+	if err != nil {
+		t.Fatalf("Unexpected error creating a temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newAppFromEmitter(mockEmitterPath).(app)
+	a.storeUrl = store.URL
+	a.storeBackend = "store,file"
+	a.buildLogFile = filepath.Join(dir, "build.log")
+	u := a.Uploader()
+
+	objects := map[string]string{
+		"step1/log.0":         "{\"m\":\"first\"}\n",
+		"step1/manifest.json": "{\"step\":\"step1\"}\n",
+		"step1/findings.json": "[]\n",
+		"step1/lines/12.json": "{\"m\":\"long\"}\n",
+		"step1/log.1":         "{\"m\":\"second\"}\n",
+	}
+	for _, p := range []string{"step1/log.0", "step1/manifest.json", "step1/findings.json", "step1/lines/12.json", "step1/log.1"} {
+		file := filepath.Join(dir, path.Base(p))
+		ioutil.WriteFile(file, []byte(objects[p]), 0644)
+		if err := u.Upload(p, file); err != nil {
+			t.Fatalf("Unexpected error uploading %s: %v", p, err)
+		}
+	}
+
+	got, _ := ioutil.ReadFile(a.buildLogFile)
+	if want := "{\"m\":\"first\"}\n{\"m\":\"second\"}\n"; string(got) != want {
+		t.Errorf("Build log file = %q, want only the log lines %q", got, want)
+	}
+	if len(stored) != len(objects) {
+		t.Errorf("The Store got %v, want every object", stored)
+	}
+}
+
+func TestAppCompressedStoreUploads(t *testing.T) {
+	stored := map[string]string{}
+	var mutex sync.Mutex
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		stored[path.Base(r.URL.Path)] = string(body)
+		want := "application/x-ndjson"
+		if strings.HasSuffix(r.URL.Path, ".gz") {
+			want = "application/gzip"
+		}
+		if got := r.Header.Get("Content-Type"); got != want {
+			t.Errorf("%s was uploaded as %s, want %s", r.URL.Path, got, want)
+		}
+	}))
+	defer store.Close()
+
+	a := newAppFromEmitter(mockEmitterPath).(app)
+	a.storeUrl = store.URL
+	a.compression = sduploader.EncodingGzip
+	if err := a.Uploader().Upload("step1/log.0", "data/emitterdata"); err != nil {
+		t.Fatalf("Unexpected error uploading: %v", err)
+	}
+
+	want, _ := ioutil.ReadFile("data/emitterdata")
+	if stored["log.0"] != string(want) {
+		t.Errorf("The Store got log.0 = %q, want the plain file", stored["log.0"])
+	}
+	r, err := sduploader.NewDecompressingReader(strings.NewReader(stored["log.0.gz"]), sduploader.EncodingGzip)
+	if err != nil {
+		t.Fatalf("Unexpected error reading log.0.gz: %v", err)
+	}
+	if got, _ := ioutil.ReadAll(r); !bytes.Equal(got, want) {
+		t.Errorf("The Store got log.0.gz = %q, want the compressed file", got)
+	}
 }
 
 func TestAppReader(t *testing.T) {
@@ -311,6 +510,319 @@ func TestArchiveLogsStepSaver(t *testing.T) {
 	}
 }
 
+func TestArchiveLogsInterleavedSteps(t *testing.T) {
+	a := newTestApp()
+	a.interleaved = true
+	a.logReader = func() io.Reader {
+		return strings.NewReader(`{"t":1,"m":"a1","s":"A"}
+{"t":2,"m":"b1","s":"B"}
+{"t":3,"m":"a2","s":"A"}
+{"t":4,"m":"b2","s":"B"}
+`)
+	}
+
+	var gotSteps []string
+	gotLogs := map[string][]string{}
+	closed := map[string]int{}
+	a.stepSaver = func(step string) StepSaver {
+		gotSteps = append(gotSteps, step)
+		return mockStepSaver{
+			writeLog: func(l *logLine) error {
+				gotLogs[step] = append(gotLogs[step], l.Message)
+				return nil
+			},
+			close: func() error {
+				closed[step]++
+				return nil
+			},
+		}
+	}
+
+	if err := ArchiveLogs(a); err != nil {
+		t.Fatalf("Unexpected error from ArchiveLogs: %v", err)
+	}
+
+	if !reflect.DeepEqual(gotSteps, []string{"A", "B"}) {
+		t.Errorf("gotSteps = %v, want [A B]", gotSteps)
+	}
+	if !reflect.DeepEqual(gotLogs["A"], []string{"a1", "a2"}) {
+		t.Errorf("gotLogs[A] = %v, want [a1 a2]", gotLogs["A"])
+	}
+	if !reflect.DeepEqual(gotLogs["B"], []string{"b1", "b2"}) {
+		t.Errorf("gotLogs[B] = %v, want [b1 b2]", gotLogs["B"])
+	}
+	if closed["A"] != 1 || closed["B"] != 1 {
+		t.Errorf("Each step should be closed once at the end of the stream. Got %v", closed)
+	}
+}
+
+func TestArchiveLogsSequentialSteps(t *testing.T) {
+	a := newTestApp()
+	a.logReader = func() io.Reader {
+		return strings.NewReader(`{"t":1,"m":"a1","s":"A"}
+{"t":2,"m":"b1","s":"B"}
+`)
+	}
+
+	var mutex sync.Mutex
+	var started []string
+	closed := map[string]bool{}
+	a.stepSaver = func(step string) StepSaver {
+		mutex.Lock()
+		defer mutex.Unlock()
+		started = append(started, step)
+		return mockStepSaver{
+			close: func() error {
+				mutex.Lock()
+				defer mutex.Unlock()
+				closed[step] = true
+				return nil
+			},
+		}
+	}
+
+	if err := ArchiveLogs(a); err != nil {
+		t.Fatalf("Unexpected error from ArchiveLogs: %v", err)
+	}
+
+	// Like the launcher, steps run one after another unless -interleaved-steps is set,
+	// and each is closed once the next one starts
+	if want := []string{"A", "B"}; !reflect.DeepEqual(started, want) {
+		t.Errorf("Started steps = %v, want %v", started, want)
+	}
+	if want := map[string]bool{"A": true, "B": true}; !reflect.DeepEqual(closed, want) {
+		t.Errorf("Closed steps = %v, want %v", closed, want)
+	}
+}
+
+func TestArchiveLogsSequentialCloseError(t *testing.T) {
+	a := newTestApp()
+	a.logReader = func() io.Reader {
+		return strings.NewReader(`{"t":1,"m":"a1","s":"A"}
+{"t":2,"m":"b1","s":"B"}
+{"t":3,"m":"b2","s":"B"}
+`)
+	}
+
+	var mutex sync.Mutex
+	gotLogs := map[string][]string{}
+	a.stepSaver = func(step string) StepSaver {
+		return mockStepSaver{
+			writeLog: func(l *logLine) error {
+				mutex.Lock()
+				defer mutex.Unlock()
+				gotLogs[step] = append(gotLogs[step], l.Message)
+				return nil
+			},
+			close: func() error {
+				if step == "A" {
+					return fmt.Errorf("Updating step meta lines: 500")
+				}
+				return nil
+			},
+		}
+	}
+
+	if err := ArchiveLogs(a); err != nil {
+		t.Fatalf("Unexpected error from ArchiveLogs: %v", err)
+	}
+
+	// A step that fails to close does not stop the steps after it
+	if want := []string{"b1", "b2"}; !reflect.DeepEqual(gotLogs["B"], want) {
+		t.Errorf("Lines of step B = %v, want %v", gotLogs["B"], want)
+	}
+}
+
+func TestArchiveLogsMalformedLines(t *testing.T) {
+	a := newTestApp()
+	a.logReader = func() io.Reader {
+		return strings.NewReader(`not json at all
+{"t":1,"m":"a1","s":"A"}
+{"t":2,"m":"a2",
+{"t":3,"m":"b1","s":"B"}
+`)
+	}
+
+	gotLogs := map[string][]string{}
+	a.stepSaver = func(step string) StepSaver {
+		return mockStepSaver{
+			writeLog: func(l *logLine) error {
+				gotLogs[step] = append(gotLogs[step], l.Message)
+				return nil
+			},
+		}
+	}
+
+	if err := ArchiveLogs(a); err != nil {
+		t.Fatalf("Unexpected error from ArchiveLogs: %v", err)
+	}
+
+	want := map[string][]string{
+		unknownStep: {"not json at all"},
+		"A":         {"a1", `{"t":2,"m":"a2",`},
+		"B":         {"b1"},
+	}
+	if !reflect.DeepEqual(gotLogs, want) {
+		t.Errorf("gotLogs = %v, want %v", gotLogs, want)
+	}
+}
+
+func TestArchiveLogsStrictDecoding(t *testing.T) {
+	a := newTestApp()
+	a.logReader = func() io.Reader {
+		return strings.NewReader("{\"t\":1,\"m\":\"a1\",\"s\":\"A\"}\nnot json\n")
+	}
+	a.lineDecoder = func() *lineDecoder {
+		return &lineDecoder{strict: true}
+	}
+	a.stepSaver = func(step string) StepSaver {
+		return mockStepSaver{}
+	}
+
+	if err := ArchiveLogs(a); err == nil {
+		t.Errorf("Expected an error from ArchiveLogs for a malformed line in strict mode")
+	}
+}
+
+func TestArchiveLogsShutdown(t *testing.T) {
+	// The emitter is still open when the log service is asked to stop
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	go writer.Write([]byte("{\"t\":1,\"m\":\"a1\",\"s\":\"A\"}\n{\"t\":2,\"m\":\"b1\",\"s\":\"B\"}\n"))
+
+	a := newTestApp()
+	a.shutdownTimeout = time.Second
+	a.logReader = func() io.Reader {
+		return reader
+	}
+
+	var mutex sync.Mutex
+	written := make(chan struct{}, 2)
+	closed := map[string]int{}
+	a.stepSaver = func(step string) StepSaver {
+		return mockStepSaver{
+			writeLog: func(l *logLine) error {
+				written <- struct{}{}
+				return nil
+			},
+			close: func() error {
+				mutex.Lock()
+				defer mutex.Unlock()
+				closed[step]++
+				return nil
+			},
+		}
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		<-written
+		<-written
+		close(stop)
+	}()
+
+	if err := ArchiveLogsUntil(a, stop); err != nil {
+		t.Fatalf("Unexpected error from ArchiveLogsUntil: %v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if closed["A"] != 1 || closed["B"] != 1 {
+		t.Errorf("Each step should be closed once on shutdown. Got %v", closed)
+	}
+}
+
+func TestArchiveLogsShutdownTimeout(t *testing.T) {
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	go writer.Write([]byte("{\"t\":1,\"m\":\"a1\",\"s\":\"A\"}\n{\"t\":2,\"m\":\"b1\",\"s\":\"B\"}\n"))
+
+	a := newTestApp()
+	a.shutdownTimeout = 50 * time.Millisecond
+	a.logReader = func() io.Reader {
+		return reader
+	}
+
+	written := make(chan struct{}, 2)
+	stuck := make(chan struct{})
+	defer close(stuck)
+	a.stepSaver = func(step string) StepSaver {
+		return mockStepSaver{
+			writeLog: func(l *logLine) error {
+				written <- struct{}{}
+				return nil
+			},
+			close: func() error {
+				if step == "B" {
+					<-stuck
+				}
+				return nil
+			},
+		}
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		<-written
+		<-written
+		close(stop)
+	}()
+
+	err := ArchiveLogsUntil(a, stop)
+	if err == nil {
+		t.Fatalf("Expected a timeout error from ArchiveLogsUntil")
+	}
+	if want := "shutdown timed out before flushing steps B"; err.Error() != want {
+		t.Errorf("err = %q, want %q", err, want)
+	}
+}
+
+func TestArchiveLogsShutdownTimeoutWhileWriting(t *testing.T) {
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	go writer.Write([]byte("{\"t\":1,\"m\":\"a1\",\"s\":\"A\"}\n"))
+
+	a := newTestApp()
+	a.shutdownTimeout = 50 * time.Millisecond
+	a.logReader = func() io.Reader {
+		return reader
+	}
+
+	writing := make(chan struct{}, 1)
+	stuck := make(chan struct{})
+	defer close(stuck)
+	a.stepSaver = func(step string) StepSaver {
+		return mockStepSaver{
+			writeLog: func(l *logLine) error {
+				// Like a write waiting on an upload that never finishes
+				writing <- struct{}{}
+				<-stuck
+				return nil
+			},
+		}
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		<-writing
+		close(stop)
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ArchiveLogsUntil(a, stop)
+	}()
+
+	select {
+	case err := <-done:
+		if want := "shutdown timed out with 0 log lines left unsaved before flushing steps A"; err == nil || err.Error() != want {
+			t.Errorf("err = %v, want %q", err, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ArchiveLogsUntil did not give up at the shutdown timeout")
+	}
+}
+
 // Make sure we don't break if there are no logs
 func TestEmptyEmitter(t *testing.T) {
 	f, err := ioutil.TempFile("", "tempfile")
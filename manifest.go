@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+const manifestFile = "manifest.json"
+
+// chunkInfo describes a single log.N file of a step. Size and Checksum are those of
+// its lines; if it is stored compressed, Encoding says how and StoredSize and
+// StoredChecksum are those of the stored object.
+type chunkInfo struct {
+	Index          int    `json:"index"`
+	FirstLine      int    `json:"firstLine"`
+	LastLine       int    `json:"lastLine"`
+	FirstTime      int64  `json:"firstTime"`
+	LastTime       int64  `json:"lastTime"`
+	Size           int64  `json:"size"`
+	Checksum       string `json:"checksum"`
+	Encoding       string `json:"encoding,omitempty"`
+	StoredSize     int64  `json:"storedSize,omitempty"`
+	StoredChecksum string `json:"storedChecksum,omitempty"`
+	Final          bool   `json:"final"`
+}
+
+// lines returns the number of lines in the chunk.
+func (c chunkInfo) lines() int {
+	if c.Size == 0 {
+		return 0
+	}
+	return c.LastLine - c.FirstLine + 1
+}
+
+// stepManifest lists the log files of a step that are in the Store, so readers don't
+// have to probe for them and can find lines by time.
+type stepManifest struct {
+	Step         string      `json:"step"`
+	Lines        int         `json:"lines"`
+	LinesPerFile int         `json:"linesPerFile"`
+	Final        bool        `json:"final"`
+	Chunks       []chunkInfo `json:"chunks"`
+}
+
+// chunks returns the description of every uploaded logFile of the step. Chunks are
+// final once they are full, or when final is set because the step is closing.
+func (s *stepSaver) chunks(final bool) []chunkInfo {
+	chunks := []chunkInfo{}
+	for i, f := range s.LogFiles() {
+		c := f.SavedInfo()
+		if c.Size == 0 {
+			continue
+		}
+		c.Index = i
+		c.Final = final || c.lines() >= s.linesPerFile
+		chunks = append(chunks, c)
+	}
+
+	return chunks
+}
+
+// saveManifest uploads the step manifest if it changed since it was last uploaded.
+// Once a final manifest is uploaded, later calls do nothing.
+func (s *stepSaver) saveManifest(final bool) error {
+	s.manifestMutex.Lock()
+	defer s.manifestMutex.Unlock()
+
+	if s.manifestFinal {
+		return nil
+	}
+
+	m := stepManifest{
+		Step:         s.StepName,
+		LinesPerFile: s.linesPerFile,
+		Final:        final,
+		Chunks:       s.chunks(final),
+	}
+	for _, c := range m.Chunks {
+		m.Lines += c.lines()
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("marshaling manifest for step %s: %v", s.StepName, err)
+	}
+	if bytes.Equal(data, s.savedManifest) {
+		return nil
+	}
+
+	file, err := ioutil.TempFile(s.logFolder, manifestFile)
+	if err != nil {
+		return fmt.Errorf("creating temporary file for %s manifest: %v", s.StepName, err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("writing %s manifest: %v", s.StepName, err)
+	}
+
+	if err := s.Uploader.Upload(path.Join(s.StepName, manifestFile), file.Name()); err != nil {
+		return fmt.Errorf("uploading %s manifest: %v", s.StepName, err)
+	}
+	s.savedManifest = data
+	s.manifestFinal = final
+
+	return nil
+}
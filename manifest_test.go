@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/screwdriver-cd/log-service/sduploader"
+)
+
+// manifestUploader records the contents of every upload.
+type manifestUploader struct {
+	mutex   sync.Mutex
+	uploads map[string][]string
+}
+
+func (m *manifestUploader) Upload(storePath string, localFile string) error {
+	contents, err := ioutil.ReadFile(localFile)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.uploads[storePath] = append(m.uploads[storePath], string(contents))
+	return nil
+}
+
+func (m *manifestUploader) last(storePath string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	u := m.uploads[storePath]
+	if len(u) == 0 {
+		return ""
+	}
+	return u[len(u)-1]
+}
+
+func (m *manifestUploader) manifest(t *testing.T) stepManifest {
+	var got stepManifest
+	if err := json.Unmarshal([]byte(m.last(testStepName+"/manifest.json")), &got); err != nil {
+		t.Fatalf("Unmarshaling manifest: %v", err)
+	}
+	return got
+}
+
+func checksum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestManifest(t *testing.T) {
+	uploader := &manifestUploader{uploads: map[string][]string{}}
+	s := NewStepSaver(testStepName, uploader, 2, MockAPI{}, "/tmp", stepOptions{manifest: true}).(*stepSaver)
+
+	for i := 0; i < 3; i++ {
+		s.WriteLog(&logLine{Time: int64(100 + i), Message: fmt.Sprintf("LogMsg #%d", i), Step: testStepName})
+	}
+	s.Save()
+
+	log0 := uploader.last(testStepName + "/log.0")
+	log1 := uploader.last(testStepName + "/log.1")
+	want := stepManifest{
+		Step:         testStepName,
+		Lines:        3,
+		LinesPerFile: 2,
+		Chunks: []chunkInfo{
+			{Index: 0, FirstLine: 0, LastLine: 1, FirstTime: 100, LastTime: 101, Size: int64(len(log0)), Checksum: checksum(log0), Final: true},
+			{Index: 1, FirstLine: 2, LastLine: 2, FirstTime: 102, LastTime: 102, Size: int64(len(log1)), Checksum: checksum(log1)},
+		},
+	}
+	if got := uploader.manifest(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("manifest = %+v, want %+v", got, want)
+	}
+
+	// Nothing changed, so the manifest isn't uploaded again
+	s.Save()
+	if len(uploader.uploads[testStepName+"/manifest.json"]) != 1 {
+		t.Errorf("Manifest uploaded %d times, want 1", len(uploader.uploads[testStepName+"/manifest.json"]))
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Unexpected error closing the StepSaver: %v", err)
+	}
+	want.Final = true
+	want.Chunks[1].Final = true
+	if got := uploader.manifest(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("final manifest = %+v, want %+v", got, want)
+	}
+}
+
+// storingUploader pretends to compress the log files it uploads.
+type storingUploader struct {
+	manifestUploader
+}
+
+func (s *storingUploader) UploadStored(storePath string, localFile string) (sduploader.StoredFile, error) {
+	return sduploader.StoredFile{Encoding: "gzip", Size: 7, Checksum: "sha256:stored"}, s.Upload(storePath, localFile)
+}
+
+func TestManifestStoredEncoding(t *testing.T) {
+	uploader := &storingUploader{manifestUploader{uploads: map[string][]string{}}}
+	s := NewStepSaver(testStepName, uploader, 2, MockAPI{}, "/tmp", stepOptions{manifest: true}).(*stepSaver)
+
+	s.WriteLog(&logLine{Time: 100, Message: "LogMsg", Step: testStepName})
+	s.Save()
+
+	log0 := uploader.last(testStepName + "/log.0")
+	want := []chunkInfo{{
+		Index: 0, FirstLine: 0, LastLine: 0, FirstTime: 100, LastTime: 100, Size: int64(len(log0)), Checksum: checksum(log0),
+		Encoding: "gzip", StoredSize: 7, StoredChecksum: "sha256:stored",
+	}}
+	if got := uploader.manifest(t).Chunks; !reflect.DeepEqual(got, want) {
+		t.Errorf("manifest chunks = %+v, want %+v", got, want)
+	}
+}
+
+func TestManifestResume(t *testing.T) {
+	uploader := &manifestUploader{uploads: map[string][]string{}}
+	first := NewStepSaver(testStepName, uploader, 2, MockAPI{}, "/tmp", stepOptions{manifest: true}).(*stepSaver)
+	for i := 0; i < 3; i++ {
+		first.WriteLog(&logLine{Time: int64(100 + i), Message: fmt.Sprintf("LogMsg #%d", i), Step: testStepName})
+	}
+	first.Close()
+
+	second := NewStepSaver(testStepName, uploader, 2, MockAPI{}, "/tmp", stepOptions{manifest: true}).(*stepSaver)
+	if err := second.Resume(checkpoint(t, first)); err != nil {
+		t.Fatalf("Unexpected error resuming: %v", err)
+	}
+	second.WriteLog(&logLine{Time: 200, Message: "LogMsg #3", Step: testStepName})
+	second.Close()
+
+	log1 := uploader.last(testStepName + "/log.1")
+	got := uploader.manifest(t)
+	if got.Lines != 4 || len(got.Chunks) != 2 {
+		t.Fatalf("manifest = %+v, want 4 lines in 2 chunks", got)
+	}
+	wantChunk := chunkInfo{Index: 1, FirstLine: 2, LastLine: 3, FirstTime: 102, LastTime: 200, Size: int64(len(log1)), Checksum: checksum(log1), Final: true}
+	if got.Chunks[1] != wantChunk {
+		t.Errorf("manifest chunk 1 = %+v, want %+v", got.Chunks[1], wantChunk)
+	}
+	if got.Chunks[0].FirstTime != 100 || got.Chunks[0].LastTime != 101 {
+		t.Errorf("manifest chunk 0 = %+v, want it carried over from the first StepSaver", got.Chunks[0])
+	}
+}
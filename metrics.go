@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/screwdriver-cd/log-service/metrics"
+)
+
+const metricsPath = "/metrics"
+
+var (
+	linesIngested = metrics.NewCounter("logservice_lines_ingested_total",
+		"Log lines received from the emitter and the HTTP ingestion endpoint.", "step")
+	bytesStored = metrics.NewCounter("logservice_stored_bytes_total",
+		"Bytes written to log files.", "step")
+	redrawsCollapsed = metrics.NewCounter("logservice_collapsed_redraws_total",
+		"Carriage-return redraws of a line that were not stored.", "step")
+	quotaDroppedLines = metrics.NewCounter("logservice_quota_dropped_lines_total",
+		"Log lines not stored because their step or build reached a quota.", "step")
+	labelsDropped = metrics.NewCounter("logservice_dropped_labels_total",
+		"Labels of emitter records dropped for going over the label limits.")
+	linesTruncated = metrics.NewCounter("logservice_truncated_lines_total",
+		"Log lines cut short for being too long.", "step")
+	chunkUploads = metrics.NewCounter("logservice_chunk_uploads_total",
+		"Uploads of log files, by whether they succeeded.", "result")
+	chunkUploadSeconds = metrics.NewHistogram("logservice_chunk_upload_duration_seconds",
+		"How long uploading a log file took.", metrics.DefaultBuckets, "result")
+	queueDepth = metrics.NewGauge("logservice_queue_depth",
+		"Log lines waiting in the queue to be saved, including spilled ones.")
+	queueDropped = metrics.NewCounter("logservice_queue_dropped_lines_total",
+		"Log lines dropped because the queue was full.")
+	activeSteps = metrics.NewGauge("logservice_active_step_savers",
+		"Steps that currently have a StepSaver.")
+)
+
+// observeUpload records the result and duration of a log file upload that started
+// at start.
+func observeUpload(start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	chunkUploads.Inc(result)
+	chunkUploadSeconds.Observe(time.Since(start).Seconds(), result)
+}
+
+// metricsServer serves the log service's metrics for Prometheus to scrape.
+type metricsServer struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// newMetricsServer returns a metricsServer for addr.
+func newMetricsServer(addr string) (*metricsServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, metrics.Default)
+
+	return &metricsServer{
+		server:   &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second},
+		listener: listener,
+	}, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *metricsServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve handles requests until the server is closed.
+func (s *metricsServer) Serve() {
+	log.Printf("Serving metrics on http://%s%s", s.Addr(), metricsPath)
+	if err := s.server.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+		log.Printf("ERROR: serving metrics: %v", err)
+	}
+}
+
+// Close stops the server.
+func (s *metricsServer) Close() error {
+	return s.server.Close()
+}
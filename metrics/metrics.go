@@ -0,0 +1,260 @@
+// Package metrics keeps counters, gauges and histograms for the log service in a
+// Prometheus registry and serves them for scraping.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MaxSeries is the most label combinations a metric keeps. Values for any further
+// combinations are added to a single series with every label set to OtherLabel, so
+// labelling by step cannot grow a metric without bound.
+const MaxSeries = 200
+
+// OtherLabel is the label value of the series that collects combinations beyond
+// MaxSeries.
+const OtherLabel = "_other"
+
+// DefaultBuckets are histogram buckets, in seconds, suited to HTTP requests.
+var DefaultBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Default is the Registry the log service serves.
+var Default = NewRegistry()
+
+// Registry is a set of metrics that are served together.
+type Registry struct {
+	registry *prometheus.Registry
+	handler  http.Handler
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	registry := prometheus.NewRegistry()
+
+	return &Registry{
+		registry: registry,
+		handler:  promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+	}
+}
+
+// register adds a collector to the registry. Registering the same name twice is a
+// programming error.
+func (r *Registry) register(name string, c prometheus.Collector) {
+	if err := r.registry.Register(c); err != nil {
+		panic(fmt.Sprintf("registering metric %s: %v", name, err))
+	}
+}
+
+// series tracks the label combinations a metric has, folding those beyond MaxSeries
+// into the OtherLabel series.
+type series struct {
+	name   string
+	labels int
+
+	mutex sync.Mutex
+	seen  map[string]bool
+}
+
+func newSeries(name string, labels []string) *series {
+	return &series{name: name, labels: len(labels), seen: map[string]bool{}}
+}
+
+// values returns the label values to record under for values.
+func (s *series) values(values []string) []string {
+	if len(values) != s.labels {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", s.name, s.labels, len(values)))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := strings.Join(values, "\xff")
+	if s.seen[key] {
+		return values
+	}
+
+	if len(s.seen) >= MaxSeries {
+		values = make([]string, s.labels)
+		for i := range values {
+			values[i] = OtherLabel
+		}
+		key = strings.Join(values, "\xff")
+	}
+	s.seen[key] = true
+
+	return values
+}
+
+// has reports whether anything was recorded under label values.
+func (s *series) has(values []string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.seen[strings.Join(values, "\xff")]
+}
+
+// read returns the current state of m.
+func read(m prometheus.Metric) *dto.Metric {
+	var out dto.Metric
+	if err := m.Write(&out); err != nil {
+		panic(fmt.Sprintf("reading metric: %v", err))
+	}
+
+	return &out
+}
+
+// Counter is a metric that only goes up.
+type Counter struct {
+	vec    *prometheus.CounterVec
+	series *series
+}
+
+// NewCounter registers a Counter with the given labels in r.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		vec:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels),
+		series: newSeries(name, labels),
+	}
+	r.register(name, c.vec)
+
+	return c
+}
+
+// NewCounter registers a Counter in the Default registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// Add adds v, which must not be negative, to the series for label values.
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter %s cannot decrease", c.series.name))
+	}
+
+	c.vec.WithLabelValues(c.series.values(values)...).Add(v)
+}
+
+// Inc adds 1 to the series for label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Value returns the current value of the series for label values.
+func (c *Counter) Value(values ...string) float64 {
+	if !c.series.has(values) {
+		return 0
+	}
+
+	return read(c.vec.WithLabelValues(values...)).GetCounter().GetValue()
+}
+
+// Gauge is a metric that can go up and down.
+type Gauge struct {
+	vec    *prometheus.GaugeVec
+	series *series
+}
+
+// NewGauge registers a Gauge with the given labels in r.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		vec:    prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels),
+		series: newSeries(name, labels),
+	}
+	r.register(name, g.vec)
+
+	return g
+}
+
+// NewGauge registers a Gauge in the Default registry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// Set sets the series for label values to v.
+func (g *Gauge) Set(v float64, values ...string) {
+	g.vec.WithLabelValues(g.series.values(values)...).Set(v)
+}
+
+// Add adds v to the series for label values.
+func (g *Gauge) Add(v float64, values ...string) {
+	g.vec.WithLabelValues(g.series.values(values)...).Add(v)
+}
+
+// Inc adds 1 to the series for label values.
+func (g *Gauge) Inc(values ...string) {
+	g.Add(1, values...)
+}
+
+// Dec subtracts 1 from the series for label values.
+func (g *Gauge) Dec(values ...string) {
+	g.Add(-1, values...)
+}
+
+// Value returns the current value of the series for label values.
+func (g *Gauge) Value(values ...string) float64 {
+	if !g.series.has(values) {
+		return 0
+	}
+
+	return read(g.vec.WithLabelValues(values...)).GetGauge().GetValue()
+}
+
+// Histogram is a metric that counts observations into buckets.
+type Histogram struct {
+	vec    *prometheus.HistogramVec
+	series *series
+}
+
+// NewHistogram registers a Histogram with the given upper bucket bounds and labels in
+// r. The bounds must be in increasing order.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("buckets of histogram %s are not sorted", name))
+	}
+
+	h := &Histogram{
+		vec:    prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels),
+		series: newSeries(name, labels),
+	}
+	r.register(name, h.vec)
+
+	return h
+}
+
+// NewHistogram registers a Histogram in the Default registry.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// Observe records v in the series for label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.vec.WithLabelValues(h.series.values(values)...).Observe(v)
+}
+
+// Count returns how many values were observed in the series for label values.
+func (h *Histogram) Count(values ...string) uint64 {
+	if !h.series.has(values) {
+		return 0
+	}
+
+	return read(h.vec.WithLabelValues(values...).(prometheus.Metric)).GetHistogram().GetSampleCount()
+}
+
+// ServeHTTP writes the registry in the exposition format the scraper asks for.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.handler.ServeHTTP(w, req)
+}
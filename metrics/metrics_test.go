@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("lines_total", "Lines seen.", "step")
+
+	c.Inc("build")
+	c.Add(2, "build")
+	c.Inc("test")
+
+	assert.Equal(t, 3.0, c.Value("build"))
+	assert.Equal(t, 1.0, c.Value("test"))
+	assert.Equal(t, 0.0, c.Value("deploy"))
+	assert.Panics(t, func() { c.Add(-1, "build") })
+	assert.Panics(t, func() { c.Inc() })
+}
+
+func TestGauge(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGauge("depth", "Queue depth.")
+
+	g.Set(5)
+	g.Inc()
+	g.Dec()
+	g.Dec()
+
+	assert.Equal(t, 4.0, g.Value())
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("lines_total", "Lines seen.")
+
+	assert.Panics(t, func() { r.NewGauge("lines_total", "Lines seen.") })
+}
+
+func TestUnsortedBuckets(t *testing.T) {
+	r := NewRegistry()
+
+	assert.Panics(t, func() { r.NewHistogram("upload_seconds", "Upload time.", []float64{1, 0.1}) })
+}
+
+func TestMaxSeries(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("lines_total", "Lines seen.", "step")
+
+	for i := 0; i < MaxSeries+10; i++ {
+		c.Inc(fmt.Sprintf("step%d", i))
+	}
+
+	assert.Equal(t, 1.0, c.Value("step0"))
+	assert.Equal(t, 0.0, c.Value(fmt.Sprintf("step%d", MaxSeries)))
+	assert.Equal(t, 10.0, c.Value(OtherLabel))
+}
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("lines_total", "Lines seen.", "step")
+	h := r.NewHistogram("upload_seconds", "Upload time.", []float64{0.1, 1})
+	r.NewGauge("depth", "Queue depth.").Set(2)
+
+	c.Inc("test")
+	c.Add(3, `say "hi"\`)
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, `# HELP depth Queue depth.
+# TYPE depth gauge
+depth 2
+# HELP lines_total Lines seen.
+# TYPE lines_total counter
+lines_total{step="say \"hi\"\\"} 3
+lines_total{step="test"} 1
+# HELP upload_seconds Upload time.
+# TYPE upload_seconds histogram
+upload_seconds_bucket{le="0.1"} 1
+upload_seconds_bucket{le="1"} 2
+upload_seconds_bucket{le="+Inf"} 3
+upload_seconds_sum 5.55
+upload_seconds_count 3
+`, w.Body.String())
+	assert.Equal(t, uint64(3), h.Count())
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("lines_total", "Lines seen.").Inc()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "lines_total 1\n")
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/metrics", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
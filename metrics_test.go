@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsServer(t *testing.T) {
+	s, err := newMetricsServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error creating metrics server: %v", err)
+	}
+	go s.Serve()
+	defer s.Close()
+
+	// Labelled metrics only show up once they have a series.
+	linesIngested.Inc("metrics-server")
+	observeUpload(time.Now(), nil)
+
+	res, err := http.Get("http://" + s.Addr().String() + metricsPath)
+	if err != nil {
+		t.Fatalf("Unexpected error scraping metrics: %v", err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("StatusCode = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	for _, name := range []string{
+		"logservice_lines_ingested_total",
+		"logservice_chunk_upload_duration_seconds",
+		"logservice_queue_depth",
+		"logservice_active_step_savers",
+	} {
+		if !strings.Contains(string(body), "# TYPE "+name+" ") {
+			t.Errorf("Metrics do not include %s:\n%s", name, body)
+		}
+	}
+}
+
+func TestArchiveLogsMetrics(t *testing.T) {
+	a := newTestApp()
+	a.logReader = func() io.Reader {
+		return strings.NewReader(`{"t":1,"m":"a1","s":"metrics-A"}
+{"t":2,"m":"b1","s":"metrics-B"}
+{"t":3,"m":"a2","s":"metrics-A"}
+`)
+	}
+	a.stepSaver = func(step string) StepSaver {
+		return mockStepSaver{}
+	}
+
+	linesA, linesB := linesIngested.Value("metrics-A"), linesIngested.Value("metrics-B")
+	active := activeSteps.Value()
+	if err := ArchiveLogs(a); err != nil {
+		t.Fatalf("Unexpected error from ArchiveLogs: %v", err)
+	}
+
+	if got := linesIngested.Value("metrics-A") - linesA; got != 2 {
+		t.Errorf("Lines ingested for step metrics-A grew by %v, want 2", got)
+	}
+	if got := linesIngested.Value("metrics-B") - linesB; got != 1 {
+		t.Errorf("Lines ingested for step metrics-B grew by %v, want 1", got)
+	}
+	if got := activeSteps.Value(); got != active {
+		t.Errorf("Active step savers = %v after every step closed, want %v", got, active)
+	}
+	if got := queueDepth.Value(); got != 0 {
+		t.Errorf("Queue depth = %v after the queue drained, want 0", got)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/screwdriver-cd/log-service/screwdriver"
+)
+
+// defaultQuotaTail is how many of the last lines of a step are stored once it
+// reaches a quota.
+const defaultQuotaTail = 1000
+
+// logQuota limits the lines and bytes stored for a step or for a whole build. A nil
+// logQuota has no limits. It is safe to share between the StepSavers of a build.
+type logQuota struct {
+	scope    string // what the quota is for, like "step" or "build"
+	maxLines int
+	maxBytes int64
+
+	mutex sync.Mutex
+	lines int
+	bytes int64
+}
+
+// newLogQuota returns a logQuota for scope, or nil if there are no limits.
+func newLogQuota(scope string, maxLines int, maxBytes int64) *logQuota {
+	if maxLines <= 0 && maxBytes <= 0 {
+		return nil
+	}
+
+	return &logQuota{scope: scope, maxLines: maxLines, maxBytes: maxBytes}
+}
+
+// Add counts lines and bytes that were stored.
+func (q *logQuota) Add(lines int, bytes int64) {
+	if q == nil {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.lines += lines
+	q.bytes += bytes
+}
+
+// Reached describes the limit that has been reached, like "step quota of 1000
+// lines", or returns "" if there is room left.
+func (q *logQuota) Reached() string {
+	if q == nil {
+		return ""
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	switch {
+	case q.maxLines > 0 && q.lines >= q.maxLines:
+		return fmt.Sprintf("%s quota of %d lines", q.scope, q.maxLines)
+	case q.maxBytes > 0 && q.bytes >= q.maxBytes:
+		return fmt.Sprintf("%s quota of %d bytes", q.scope, q.maxBytes)
+	}
+
+	return ""
+}
+
+// logCutoff keeps the last lines of a step once it reaches a quota, counting the
+// lines that are pushed out.
+type logCutoff struct {
+	quota        string // the quota that was reached
+	time         int64  // time of the first line that was not stored right away
+	max          int    // how many lines to keep
+	tail         []groupedLine
+	next         int // where the next line goes once tail is full
+	droppedLines int
+	droppedBytes int64
+}
+
+// Keep adds a line to the last lines of the step, dropping the oldest one if there
+// are too many.
+func (c *logCutoff) Keep(g groupedLine) {
+	if len(c.tail) < c.max {
+		c.tail = append(c.tail, g)
+		return
+	}
+
+	dropped := g
+	if c.max > 0 {
+		dropped = c.tail[c.next]
+		c.tail[c.next] = g
+		c.next = (c.next + 1) % c.max
+	}
+	c.droppedLines++
+	c.droppedBytes += storedSize(dropped.line)
+	quotaDroppedLines.Inc(dropped.line.Step)
+}
+
+// storedSize is about how many bytes a line would take in the log files, which is
+// what the byte quotas count, for a line that is never written.
+func storedSize(l *logLine) int64 {
+	data, err := json.Marshal(storedLogLine{Time: l.Time, Message: l.Message, StepName: l.Step, Stream: l.Stream, Labels: l.Labels})
+	if err != nil {
+		return int64(len(l.Message))
+	}
+
+	// The encoder ends each line with a newline
+	return int64(len(data)) + 1
+}
+
+// Lines returns the kept lines in order.
+func (c *logCutoff) Lines() []groupedLine {
+	return append(append([]groupedLine{}, c.tail[c.next:]...), c.tail[:c.next]...)
+}
+
+// Marker returns the line stored in place of the dropped lines.
+func (c *logCutoff) Marker(step string) *logLine {
+	return &logLine{
+		Time: c.time,
+		Message: fmt.Sprintf("[log-service] %d lines (%d bytes) were not stored after the %s was reached; the last %d lines of the step follow",
+			c.droppedLines, c.droppedBytes, c.quota, len(c.tail)),
+		Step: step,
+	}
+}
+
+// cutoffJournal is how a logCutoff is kept in the journal of a step, so the last
+// lines of the step are still stored if the log service is restarted.
+type cutoffJournal struct {
+	Quota        string     `json:"quota"`
+	Time         int64      `json:"t"`
+	DroppedLines int        `json:"droppedLines"`
+	DroppedBytes int64      `json:"droppedBytes"`
+	Tail         []keptLine `json:"tail"`
+}
+
+// keptLine is a line of a cutoffJournal, along with its labels and its role in an
+// event.
+type keptLine struct {
+	Line   *logLine          `json:"line"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Role   int               `json:"role,omitempty"`
+}
+
+// Journal describes the cutoff for the journal. Lines have not been scanned for
+// credentials yet, so mask is applied to their messages and labels first.
+func (c *logCutoff) Journal(mask func(string) string) *cutoffJournal {
+	j := &cutoffJournal{Quota: c.quota, Time: c.time, DroppedLines: c.droppedLines, DroppedBytes: c.droppedBytes}
+	for _, g := range c.Lines() {
+		l := *g.line
+		l.Message = mask(l.Message)
+		if len(l.Labels) != 0 {
+			l.Labels = make(map[string]string, len(g.line.Labels))
+			for name, value := range g.line.Labels {
+				l.Labels[name] = mask(value)
+			}
+		}
+		j.Tail = append(j.Tail, keptLine{&l, l.Labels, g.role})
+	}
+
+	return j
+}
+
+// Restore returns the logCutoff described by the journal, keeping at most max of
+// its lines.
+func (j *cutoffJournal) Restore(max int) *logCutoff {
+	c := &logCutoff{quota: j.Quota, time: j.Time, max: max, droppedLines: j.DroppedLines, droppedBytes: j.DroppedBytes}
+	for _, k := range j.Tail {
+		k.Line.Labels = k.Labels
+		c.Keep(groupedLine{k.Line, k.Role})
+	}
+
+	return c
+}
+
+// journalCutoff describes the cutoff of the step for its journal, or returns nil if
+// the step has not reached a quota.
+func (s *stepSaver) journalCutoff() *cutoffJournal {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if s.cutoff == nil {
+		return nil
+	}
+
+	return s.cutoff.Journal(func(text string) string {
+		return maskText(s.options.secrets, s.options.detector, text)
+	})
+}
+
+// store writes a line unless the step or the build has reached a quota. From then
+// on, only the last lines of the step are kept, to be stored when it is closed.
+func (s *stepSaver) store(l *logLine, role int) error {
+	if s.cutoff == nil {
+		reached := s.quota.Reached()
+		if len(reached) == 0 {
+			reached = s.options.buildQuota.Reached()
+		}
+		if len(reached) == 0 {
+			return s.writeCounted(l, role)
+		}
+
+		log.Printf("WARNING: step %s reached the %s, keeping only its last %d lines from line %d on", s.StepName, reached, s.options.quotaTail, s.lineCount)
+		s.cutoff = &logCutoff{quota: reached, time: l.Time, max: s.options.quotaTail}
+	}
+
+	s.cutoff.Keep(groupedLine{l, role})
+	return nil
+}
+
+// writeCounted writes a line, counting it against the quotas.
+func (s *stepSaver) writeCounted(l *logLine, role int) error {
+	lines, bytes := s.lineCount, s.storedBytes
+	err := s.writeLine(l, role)
+	s.quota.Add(s.lineCount-lines, s.storedBytes-bytes)
+	s.options.buildQuota.Add(s.lineCount-lines, s.storedBytes-bytes)
+
+	return err
+}
+
+// releaseCutoff stores the last lines of a step that reached a quota, after a line
+// describing the lines that were dropped, and returns what to report to Screwdriver.
+func (s *stepSaver) releaseCutoff() (*screwdriver.LogCutoff, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	c := s.cutoff
+	if c == nil {
+		return nil, nil
+	}
+	s.cutoff = nil
+
+	var report *screwdriver.LogCutoff
+	if c.droppedLines > 0 {
+		report = &screwdriver.LogCutoff{Quota: c.quota, Line: s.lineCount, DroppedLines: c.droppedLines, DroppedBytes: c.droppedBytes}
+		if err := s.writeCounted(c.Marker(s.StepName), eventNone); err != nil {
+			return report, err
+		}
+	}
+	for _, g := range c.Lines() {
+		if err := s.writeCounted(g.line, g.role); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/log-service/screwdriver"
+)
+
+func TestLogQuota(t *testing.T) {
+	if q := newLogQuota("step", 0, 0); q != nil {
+		t.Errorf("newLogQuota with no limits = %+v, want nil", q)
+	}
+	var none *logQuota
+	none.Add(10, 10)
+	if got := none.Reached(); got != "" {
+		t.Errorf("A nil quota reached %q", got)
+	}
+
+	q := newLogQuota("step", 3, 100)
+	q.Add(2, 50)
+	if got := q.Reached(); got != "" {
+		t.Errorf("Reached() = %q with room left", got)
+	}
+	q.Add(1, 10)
+	if got, want := q.Reached(), "step quota of 3 lines"; got != want {
+		t.Errorf("Reached() = %q, want %q", got, want)
+	}
+
+	q = newLogQuota("build", 0, 100)
+	q.Add(1, 100)
+	if got, want := q.Reached(), "build quota of 100 bytes"; got != want {
+		t.Errorf("Reached() = %q, want %q", got, want)
+	}
+}
+
+func TestLogCutoff(t *testing.T) {
+	c := &logCutoff{max: 2}
+	for i := 0; i < 5; i++ {
+		c.Keep(groupedLine{&logLine{Message: fmt.Sprint("line", i)}, eventNone})
+	}
+
+	var got []string
+	for _, g := range c.Lines() {
+		got = append(got, g.line.Message)
+	}
+	if want := []string{"line3", "line4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Lines() = %v, want %v", got, want)
+	}
+	// Dropped bytes are counted the way the byte quotas count stored lines
+	size := int64(len(`{"t":0,"m":"line0","n":0,"s":""}` + "\n"))
+	if c.droppedLines != 3 || c.droppedBytes != 3*size {
+		t.Errorf("Dropped %d lines of %d bytes, want 3 lines of %d bytes", c.droppedLines, c.droppedBytes, 3*size)
+	}
+
+	c = &logCutoff{}
+	c.Keep(groupedLine{&logLine{Message: "gone"}, eventNone})
+	if len(c.Lines()) != 0 || c.droppedLines != 1 {
+		t.Errorf("A cutoff keeping no lines kept %d and dropped %d", len(c.Lines()), c.droppedLines)
+	}
+}
+
+// tailedMessages returns the messages stored for a step, as published to live tails.
+func tailedMessages(t *testing.T, h *tailHub, step string) []string {
+	backlog, _, _ := h.Subscribe(step, 0)
+
+	var messages []string
+	for i, e := range backlog {
+		var l storedLogLine
+		if err := json.Unmarshal(e.data, &l); err != nil {
+			t.Fatalf("Unexpected error reading stored line: %v", err)
+		}
+		if l.Line != i {
+			t.Errorf("Line %d is numbered %d", i, l.Line)
+		}
+		messages = append(messages, l.Message)
+	}
+
+	return messages
+}
+
+func TestSaverStepQuota(t *testing.T) {
+	var cutoffs []screwdriver.LogCutoff
+	lineCount := 0
+	api := MockAPI{
+		updateStepLines: func(stepName string, lines int) error {
+			lineCount = lines
+			return nil
+		},
+		updateStepCutoff: func(stepName string, cutoff screwdriver.LogCutoff) error {
+			cutoffs = append(cutoffs, cutoff)
+			return nil
+		},
+	}
+	h := newTailHub(100)
+	s := NewStepSaver(testStepName, &mockSDUploader{}, defaultLinesPerFile, api, "/tmp", stepOptions{tail: h, stepMaxLines: 3, quotaTail: 2})
+	size := int64(len(fmt.Sprintf(`{"t":3,"m":"m3","n":3,"s":%q}`+"\n", testStepName)))
+
+	for i := 0; i < 10; i++ {
+		if err := s.WriteLog(&logLine{Time: int64(i), Message: fmt.Sprint("m", i), Step: testStepName}); err != nil {
+			t.Fatalf("Unexpected error writing log: %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Unexpected error closing the StepSaver: %v", err)
+	}
+
+	want := []string{
+		"m0", "m1", "m2",
+		fmt.Sprintf("[log-service] 5 lines (%d bytes) were not stored after the step quota of 3 lines was reached; the last 2 lines of the step follow", 5*size),
+		"m8", "m9",
+	}
+	if got := tailedMessages(t, h, testStepName); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stored %q, want %q", got, want)
+	}
+	if lineCount != 6 {
+		t.Errorf("Set step lines to %d, want 6", lineCount)
+	}
+	wantCutoff := []screwdriver.LogCutoff{{Quota: "step quota of 3 lines", Line: 3, DroppedLines: 5, DroppedBytes: 5 * size}}
+	if !reflect.DeepEqual(cutoffs, wantCutoff) {
+		t.Errorf("Reported cutoffs %+v, want %+v", cutoffs, wantCutoff)
+	}
+}
+
+func TestSaverCutoffReportIsBestEffort(t *testing.T) {
+	lineCount := 0
+	api := MockAPI{
+		updateStepLines: func(stepName string, lines int) error {
+			lineCount = lines
+			return nil
+		},
+		updateStepCutoff: func(stepName string, cutoff screwdriver.LogCutoff) error {
+			return errors.New("400 Bad Request: \"logCutoff\" is not allowed")
+		},
+	}
+	s := NewStepSaver(testStepName, &mockSDUploader{}, defaultLinesPerFile, api, "/tmp", stepOptions{stepMaxLines: 1, quotaTail: 1})
+	for i := 0; i < 3; i++ {
+		s.WriteLog(&logLine{Time: int64(i), Message: fmt.Sprint("m", i), Step: testStepName})
+	}
+
+	if err := s.Close(); err != nil {
+		t.Errorf("Close() = %v, want a failed cutoff report to be ignored", err)
+	}
+	if lineCount != 3 {
+		t.Errorf("Set step lines to %d, want 3", lineCount)
+	}
+}
+
+func TestCutoffJournal(t *testing.T) {
+	c := &logCutoff{quota: "step quota of 1 lines", time: 5, max: 2}
+	c.Keep(groupedLine{&logLine{Time: 5, Message: "token=hunter2", Step: "a"}, eventHead})
+	c.Keep(groupedLine{&logLine{Time: 6, Message: "next", Step: "a", Labels: map[string]string{"pass": "hunter2"}}, eventContinuation})
+	c.Keep(groupedLine{&logLine{Time: 7, Message: "last", Step: "a"}, eventNone})
+
+	data, err := json.Marshal(c.Journal(func(text string) string {
+		return strings.Replace(text, "hunter2", "***", -1)
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling journal: %v", err)
+	}
+	if strings.Contains(string(data), "hunter2") {
+		t.Errorf("Journal %s has an unmasked secret", data)
+	}
+
+	var j cutoffJournal
+	if err := json.Unmarshal(data, &j); err != nil {
+		t.Fatalf("Unexpected error unmarshaling journal: %v", err)
+	}
+	r := j.Restore(2)
+	want := []groupedLine{
+		{&logLine{Time: 6, Message: "next", Step: "a", Labels: map[string]string{"pass": "***"}}, eventContinuation},
+		{&logLine{Time: 7, Message: "last", Step: "a"}, eventNone},
+	}
+	if got := r.Lines(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Restored lines %v, want %v", got, want)
+	}
+	if r.quota != c.quota || r.time != 5 || r.droppedLines != 1 || r.droppedBytes != c.droppedBytes {
+		t.Errorf("Restored %+v, want the quota and drop counts of %+v", r, c)
+	}
+}
+
+func TestSaverBuildQuota(t *testing.T) {
+	reported := 0
+	api := MockAPI{
+		updateStepCutoff: func(stepName string, cutoff screwdriver.LogCutoff) error {
+			reported++
+			return nil
+		},
+	}
+	h := newTailHub(100)
+	options := stepOptions{tail: h, buildQuota: newLogQuota("build", 3, 0), quotaTail: 5}
+	a := NewStepSaver("a", &mockSDUploader{}, defaultLinesPerFile, api, "/tmp", options)
+	b := NewStepSaver("b", &mockSDUploader{}, defaultLinesPerFile, api, "/tmp", options)
+
+	a.WriteLog(&logLine{Time: 1, Message: "a0", Step: "a"})
+	a.WriteLog(&logLine{Time: 2, Message: "a1", Step: "a"})
+	for i := 0; i < 3; i++ {
+		b.WriteLog(&logLine{Time: int64(i), Message: fmt.Sprint("b", i), Step: "b"})
+	}
+	for _, s := range []StepSaver{a, b} {
+		if err := s.Close(); err != nil {
+			t.Fatalf("Unexpected error closing the StepSaver: %v", err)
+		}
+	}
+
+	if got, want := tailedMessages(t, h, "a"), []string{"a0", "a1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Stored %q for step a, want %q", got, want)
+	}
+	// Nothing was dropped, so there is no marker and no report
+	if got, want := tailedMessages(t, h, "b"), []string{"b0", "b1", "b2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Stored %q for step b, want %q", got, want)
+	}
+	if reported != 0 {
+		t.Errorf("Reported %d cutoffs, want none", reported)
+	}
+}
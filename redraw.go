@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// redrawCollapser renders messages that redraw themselves with carriage returns, like
+// progress bars and spinners, the way a terminal would, so only what was finally on
+// screen is stored instead of every redraw.
+type redrawCollapser struct {
+	// sample keeps every sample-th intermediate state as a line of its own; 0 keeps
+	// only the final state
+	sample int
+}
+
+// screenLine is a line of terminal cells being drawn. Escape sequences other than
+// erasing are kept with the character written after them.
+type screenLine struct {
+	cells   []string
+	cursor  int
+	pending string // escape sequences waiting for the next character
+}
+
+// Collapse returns the lines to store for l: its final rendered state, preceded by
+// any sampled intermediate states. Lines without redraws are returned as they are.
+func (c *redrawCollapser) Collapse(l *logLine) []*logLine {
+	// A carriage return at the end of the line only ends it, as in CRLF output
+	message := strings.TrimRight(l.Message, "\r")
+	if !strings.ContainsAny(message, "\r\b") {
+		if len(message) != len(l.Message) {
+			return []*logLine{withMessage(l, message)}
+		}
+		return []*logLine{l}
+	}
+
+	var lines []*logLine
+	screen := &screenLine{}
+	redraws := 0
+	for i := 0; i < len(message); {
+		switch message[i] {
+		case '\r':
+			redraws++
+			if c.sample > 0 && redraws%c.sample == 0 {
+				if state := screen.String(); len(strings.TrimSpace(state)) != 0 {
+					lines = append(lines, withMessage(l, state))
+				}
+			}
+			screen.cursor = 0
+			i++
+		case '\b':
+			if screen.cursor > 0 {
+				screen.cursor--
+			}
+			i++
+		case escape:
+			end, params, final := parseEscape(message[i:])
+			if final == 'K' {
+				screen.erase(params)
+			} else {
+				screen.pending += message[i : i+end]
+			}
+			i += end
+		default:
+			r, size := utf8.DecodeRuneInString(message[i:])
+			if r == utf8.RuneError && size == 1 {
+				screen.put(message[i : i+1])
+			} else {
+				screen.put(string(r))
+			}
+			i += size
+		}
+	}
+	redrawsCollapsed.Add(float64(redraws-len(lines)), l.Step)
+
+	return append(lines, withMessage(l, screen.String()))
+}
+
+// withMessage returns a copy of l with another message.
+func withMessage(l *logLine, message string) *logLine {
+	line := *l
+	line.Message = message
+
+	return &line
+}
+
+// put writes a character at the cursor and moves the cursor on.
+func (s *screenLine) put(char string) {
+	for len(s.cells) < s.cursor {
+		s.cells = append(s.cells, " ")
+	}
+
+	cell := s.pending + char
+	s.pending = ""
+	if s.cursor < len(s.cells) {
+		s.cells[s.cursor] = cell
+	} else {
+		s.cells = append(s.cells, cell)
+	}
+	s.cursor++
+}
+
+// erase handles an Erase in Line sequence: to the end of the line by default, to the
+// cursor with 1, and the whole line with 2.
+func (s *screenLine) erase(params string) {
+	switch params {
+	case "", "0":
+		if s.cursor < len(s.cells) {
+			s.cells = s.cells[:s.cursor]
+		}
+	case "1":
+		for i := 0; i <= s.cursor && i < len(s.cells); i++ {
+			s.cells[i] = " "
+		}
+	case "2":
+		s.cells = nil
+	}
+}
+
+// String returns what is on the line, with any escape sequences that were not
+// followed by a character at the end.
+func (s *screenLine) String() string {
+	return strings.Join(s.cells, "") + s.pending
+}
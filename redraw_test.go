@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func collapsedMessages(c *redrawCollapser, message string) []string {
+	var messages []string
+	for _, l := range c.Collapse(&logLine{Time: 1, Message: message, Step: "main"}) {
+		messages = append(messages, l.Message)
+	}
+	return messages
+}
+
+func TestCollapseRedraws(t *testing.T) {
+	c := &redrawCollapser{}
+
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{"plain line", "plain line"},
+		{"crlf line\r", "crlf line"},
+		{"10%\r50%\r100%", "100%"},
+		// Shorter redraws only overwrite the start of the line
+		{"downloading....\rdone", "doneloading...."},
+		{"downloading....\rdone\x1b[K", "done"},
+		{"abc\x1b[2K\rxy", "xy"},
+		{"spin |\b/\b-", "spin -"},
+		{"\x1b[32m50%\r\x1b[32m100%\x1b[0m", "\x1b[32m100%\x1b[0m"},
+		{"ab\rcd\x1b[1K", "  "},
+	}
+
+	for _, tt := range tests {
+		if got := collapsedMessages(c, tt.message); !reflect.DeepEqual(got, []string{tt.want}) {
+			t.Errorf("Collapse(%q) = %q, want [%q]", tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestCollapseKeepsStream(t *testing.T) {
+	c := &redrawCollapser{sample: 1}
+
+	for _, l := range c.Collapse(&logLine{Time: 1, Message: "10%\r100%", Step: "main", Stream: streamStderr}) {
+		if l.Stream != streamStderr || l.Step != "main" || l.Time != 1 {
+			t.Errorf("Collapsed line %v should keep the time, step and stream of the line", l)
+		}
+	}
+}
+
+func TestCollapseRedrawsSample(t *testing.T) {
+	c := &redrawCollapser{sample: 2}
+
+	got := collapsedMessages(c, "1/5\r2/5\r3/5\r4/5\r5/5")
+	want := []string{"2/5", "4/5", "5/5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Collapse = %q, want %q", got, want)
+	}
+}
+
+func TestSaverCollapsesRedraws(t *testing.T) {
+	s := newTestStepSaver()
+	s.redraws = &redrawCollapser{}
+
+	if err := s.WriteLog(&logLine{Time: 1, Message: "0%\r50%\r100%", Step: testStepName}); err != nil {
+		t.Fatalf("Unexpected error writing log: %v", err)
+	}
+	if err := s.WriteLog(&logLine{Time: 2, Message: "done", Step: testStepName}); err != nil {
+		t.Fatalf("Unexpected error writing log: %v", err)
+	}
+
+	contents, _ := s.LogFiles()[0].Contents()
+	want := `{"t":1,"m":"100%","n":0,"s":"` + testStepName + `"}
+{"t":2,"m":"done","n":1,"s":"` + testStepName + `"}
+`
+	if string(contents) != want {
+		t.Errorf("Stored %s, want %s", contents, want)
+	}
+}
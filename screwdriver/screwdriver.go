@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
+	"github.com/screwdriver-cd/log-service/metrics"
 )
 
 // default configs
@@ -24,9 +25,17 @@ var httpTimeout = time.Duration(20) * time.Second
 const retryWaitMin = 100
 const retryWaitMax = 300
 
+var (
+	requestRetries = metrics.NewCounter("logservice_api_request_retries_total",
+		"Screwdriver API requests that were retried.")
+	requestFailures = metrics.NewCounter("logservice_api_request_failures_total",
+		"Screwdriver API requests that failed after any retries.")
+)
+
 // API is a Screwdriver API endpoint
 type API interface {
 	UpdateStepLines(stepName string, lineCount int) error
+	UpdateStepCutoff(stepName string, cutoff LogCutoff) error
 }
 
 // SDError is an error response from the Screwdriver API
@@ -65,6 +74,11 @@ func New(buildID, url, token string) (API, error) {
 	retryClient.RetryWaitMax = time.Duration(retryWaitMax) * time.Millisecond
 	retryClient.Backoff = retryablehttp.LinearJitterBackoff
 	retryClient.HTTPClient.Timeout = httpTimeout
+	retryClient.RequestLogHook = func(_ retryablehttp.Logger, _ *http.Request, attempt int) {
+		if attempt > 0 {
+			requestRetries.Inc()
+		}
+	}
 
 	newAPI := api{
 		buildID,
@@ -80,6 +94,20 @@ type StepLinesPayload struct {
 	Lines int `json:"lines"`
 }
 
+// LogCutoff describes the lines of a step that were not stored because a log quota
+// was reached.
+type LogCutoff struct {
+	Quota        string `json:"quota"`
+	Line         int    `json:"line"`
+	DroppedLines int    `json:"droppedLines"`
+	DroppedBytes int64  `json:"droppedBytes"`
+}
+
+// StepCutoffPayload is a Screwdriver Step payload reporting a log cutoff.
+type StepCutoffPayload struct {
+	LogCutoff LogCutoff `json:"logCutoff"`
+}
+
 func (a api) makeURL(path string) (*url.URL, error) {
 	version := "v4"
 	fullpath := fmt.Sprintf("%s/%s/%s", a.baseURL, version, path)
@@ -119,6 +147,7 @@ func (a api) write(url *url.URL, requestType string, bodyType string, payload io
 	}
 
 	if err != nil {
+		requestFailures.Inc()
 		log.Printf("WARNING: received error from %s(%s): %v ", requestType, url.String(), err)
 		return nil, fmt.Errorf("WARNING: received error from %s(%s): %v ", requestType, url.String(), err)
 	}
@@ -130,6 +159,7 @@ func (a api) write(url *url.URL, requestType string, bodyType string, payload io
 	}
 
 	if res.StatusCode/100 != 2 {
+		requestFailures.Inc()
 		var errParse SDError
 		parseError := json.Unmarshal(body, &errParse)
 		if parseError != nil {
@@ -169,3 +199,24 @@ func (a api) UpdateStepLines(stepName string, lineCount int) error {
 
 	return nil
 }
+
+// UpdateStepCutoff reports that a step reached a log quota. Screwdriver versions that
+// do not keep a log cutoff for steps reject it, so callers treat it as best-effort.
+func (a api) UpdateStepCutoff(stepName string, cutoff LogCutoff) error {
+	u, err := a.makeURL(fmt.Sprintf("builds/%s/steps/%s", a.buildID, stepName))
+	if err != nil {
+		return fmt.Errorf("Creating url: %v", err)
+	}
+
+	payload, err := json.Marshal(StepCutoffPayload{LogCutoff: cutoff})
+	if err != nil {
+		return fmt.Errorf("Marshaling JSON for Step log cutoff: %v", err)
+	}
+
+	_, err = a.put(u, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("Posting to Step log cutoff: %v", err)
+	}
+
+	return nil
+}
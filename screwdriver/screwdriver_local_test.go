@@ -14,3 +14,11 @@ func TestUpdateStepLinesLocal(t *testing.T) {
 		)
 	}
 }
+
+func TestUpdateStepCutoffLocal(t *testing.T) {
+	testAPI := localApi{}
+
+	if actual := testAPI.UpdateStepCutoff("test", LogCutoff{}); actual != nil {
+		t.Errorf("localApi.UpdateStepCutoff() = %v, want nil", actual)
+	}
+}
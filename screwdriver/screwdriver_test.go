@@ -77,6 +77,30 @@ func TestUpdateStepLines(t *testing.T) {
 	}
 }
 
+func TestUpdateStepCutoff(t *testing.T) {
+	client := retryablehttp.NewClient()
+	http := makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+
+		want := `{"logCutoff":{"quota":"step quota of 10 lines","line":10,"droppedLines":5,"droppedBytes":60}}`
+		if buf.String() != want {
+			t.Errorf("buf.String() = %q, want %q", buf.String(), want)
+		}
+		if r.URL.Path != "/v4/builds/123/steps/step1" {
+			t.Errorf("Path = %q, want %q", r.URL.Path, "/v4/builds/123/steps/step1")
+		}
+	})
+	client.HTTPClient = http
+	testAPI := api{"123", "http://fakeurl", "faketoken", client}
+
+	err := testAPI.UpdateStepCutoff("step1", LogCutoff{Quota: "step quota of 10 lines", Line: 10, DroppedLines: 5, DroppedBytes: 60})
+
+	if err != nil {
+		t.Errorf("Unexpected error from UpdateStepCutoff: %v", err)
+	}
+}
+
 func TestUpdateStepLinesRetry(t *testing.T) {
 	var client *retryablehttp.Client
 	client = retryablehttp.NewClient()
@@ -0,0 +1,181 @@
+package sduploader
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// EncodingGzip is the Content-Encoding of gzipped log files, the only compression
+// that is supported.
+const EncodingGzip = "gzip"
+
+// EncodedUploader is an SDUploader that can label an upload with its Content-Encoding,
+// so the object keeps its name and readers can decompress it transparently.
+type EncodedUploader interface {
+	SDUploader
+	UploadEncoded(path string, filePath string, encoding string) error
+}
+
+// StoredFile describes how an uploader stored a file that it changed on the way,
+// such as by compressing it. Checksum is like "sha256:<hex>".
+type StoredFile struct {
+	Encoding string
+	Size     int64
+	Checksum string
+}
+
+// StoringUploader is an SDUploader that reports how it stored each file.
+type StoringUploader interface {
+	SDUploader
+	UploadStored(path string, filePath string) (StoredFile, error)
+}
+
+// compressionSuffixes are the object name extensions for each encoding, used for
+// uploaders that cannot label uploads with an encoding, like the Store
+var compressionSuffixes = map[string]string{
+	EncodingGzip: ".gz",
+}
+
+// CheckEncoding returns an error for encodings that are not supported.
+func CheckEncoding(encoding string) error {
+	if encoding != EncodingGzip {
+		return fmt.Errorf("unknown compression %q, only %s is supported", encoding, EncodingGzip)
+	}
+	return nil
+}
+
+type sdCompressingUploader struct {
+	uploader SDUploader
+	encoding string
+}
+
+// copiesUploader is an SDUploader that is given both the plain and the compressed
+// copy of a file and decides itself which to store, like one fanning out to
+// uploaders of both kinds.
+type copiesUploader interface {
+	uploadCopies(path string, plainPath string, compressedPath string, encoding string) error
+}
+
+// NewCompressingUploader returns an SDUploader that compresses files before handing
+// them to uploader. Uploaders that are not EncodedUploaders keep the plain file under
+// its own name, for readers that expect plain NDJSON, and also get the compressed
+// file under a name with the encoding's extension, e.g. log.0.gz. Compressed files
+// are always uploaded whole.
+func NewCompressingUploader(uploader SDUploader, encoding string) (SDUploader, error) {
+	if err := CheckEncoding(encoding); err != nil {
+		return nil, err
+	}
+
+	return &sdCompressingUploader{uploader, encoding}, nil
+}
+
+// Upload compresses a file and uploads it.
+func (c *sdCompressingUploader) Upload(path string, filePath string) error {
+	_, err := c.UploadStored(path, filePath)
+	return err
+}
+
+// UploadStored compresses a file and uploads it, returning the size and checksum of
+// what was uploaded.
+func (c *sdCompressingUploader) UploadStored(path string, filePath string) (StoredFile, error) {
+	compressed, stored, err := compressFile(filePath)
+	if err != nil {
+		return stored, fmt.Errorf("compressing %q: %v", filePath, err)
+	}
+	defer os.Remove(compressed)
+	stored.Encoding = c.encoding
+
+	return stored, uploadCompressed(c.uploader, path, filePath, compressed, c.encoding)
+}
+
+// uploadCompressed uploads the compressed copy of a file to uploader under the name
+// of the file if it can label it with its encoding, and both the plain copy and the
+// compressed one under a suffixed name otherwise.
+func uploadCompressed(uploader SDUploader, path string, plainPath string, compressedPath string, encoding string) error {
+	if cu, ok := uploader.(copiesUploader); ok {
+		return cu.uploadCopies(path, plainPath, compressedPath, encoding)
+	}
+
+	if eu, ok := uploader.(EncodedUploader); ok {
+		return eu.UploadEncoded(path, compressedPath, encoding)
+	}
+
+	if err := uploader.Upload(path, plainPath); err != nil {
+		return err
+	}
+
+	return uploader.Upload(path+compressionSuffixes[encoding], compressedPath)
+}
+
+// compressFile writes a gzipped copy of a file next to it and returns its path, along
+// with its size and checksum.
+func compressFile(filePath string) (string, StoredFile, error) {
+	var stored StoredFile
+	input, err := os.Open(filePath)
+	if err != nil {
+		return "", stored, err
+	}
+	defer input.Close()
+
+	output, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".gz")
+	if err != nil {
+		return "", stored, err
+	}
+	defer output.Close()
+
+	hash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(output, hash)}
+	w := gzip.NewWriter(counter)
+	if _, err := io.Copy(w, input); err != nil {
+		os.Remove(output.Name())
+		return "", stored, err
+	}
+	if err := w.Close(); err != nil {
+		os.Remove(output.Name())
+		return "", stored, err
+	}
+
+	stored.Size = counter.n
+	stored.Checksum = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	return output.Name(), stored, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewDecompressingReader returns a Reader of the uncompressed contents of r, which is
+// compressed with encoding. An empty encoding detects gzip from the data itself and
+// passes anything else through unchanged, so compressed and uncompressed logs can
+// be read alike.
+func NewDecompressingReader(r io.Reader, encoding string) (io.Reader, error) {
+	if len(encoding) != 0 {
+		if err := CheckEncoding(encoding); err != nil {
+			return nil, err
+		}
+		return gzip.NewReader(r)
+	}
+
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+
+	return br, nil
+}
@@ -0,0 +1,134 @@
+package sduploader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// capturingUploader keeps the contents of the files it is asked to upload.
+type capturingUploader struct {
+	uploads map[string][]byte
+}
+
+func (c *capturingUploader) Upload(path string, filePath string) error {
+	data, err := ioutil.ReadFile(filePath)
+	c.uploads[path] = data
+	return err
+}
+
+func gunzip(t *testing.T, data []byte) []byte {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	plain, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return plain
+}
+
+func TestNewCompressingUploaderErrors(t *testing.T) {
+	_, err := NewCompressingUploader(&capturingUploader{}, "zstd")
+	assert.EqualError(t, err, `unknown compression "zstd", only gzip is supported`)
+}
+
+func TestCompressingUploaderKeepsPlainFile(t *testing.T) {
+	want, _ := ioutil.ReadFile("../data/emitterdata")
+	inner := &capturingUploader{uploads: map[string][]byte{}}
+	u, err := NewCompressingUploader(inner, EncodingGzip)
+	require.NoError(t, err)
+
+	assert.NoError(t, u.Upload("step/log.0", "../data/emitterdata"))
+
+	assert.Equal(t, want, inner.uploads["step/log.0"], "readers of plain log files should still find them")
+	require.Contains(t, inner.uploads, "step/log.0.gz")
+	assert.True(t, len(inner.uploads["step/log.0.gz"]) < len(want), "the upload should be smaller than the file")
+	assert.Equal(t, want, gunzip(t, inner.uploads["step/log.0.gz"]))
+}
+
+func TestCompressingUploaderStored(t *testing.T) {
+	inner := &capturingUploader{uploads: map[string][]byte{}}
+	u, _ := NewCompressingUploader(inner, EncodingGzip)
+
+	stored, err := u.(StoringUploader).UploadStored("step/log.0", "../data/emitterdata")
+	require.NoError(t, err)
+
+	uploaded := inner.uploads["step/log.0.gz"]
+	sum := sha256.Sum256(uploaded)
+	assert.Equal(t, StoredFile{
+		Encoding: EncodingGzip,
+		Size:     int64(len(uploaded)),
+		Checksum: "sha256:" + hex.EncodeToString(sum[:]),
+	}, stored)
+}
+
+func TestFanOutUploadCompressed(t *testing.T) {
+	want, _ := ioutil.ReadFile("../data/emitterdata")
+	logFile, _ := ioutil.TempFile("", "build.log")
+	logFile.Close()
+	defer os.Remove(logFile.Name())
+
+	store := &capturingUploader{uploads: map[string][]byte{}}
+	f := NewFanOutUploader(
+		Destination{Name: "store", Uploader: store, Required: true},
+		Destination{Name: "file", Uploader: NewLocalUploader(logFile.Name()), Required: true},
+	)
+	u, _ := NewCompressingUploader(f, EncodingGzip)
+	assert.NoError(t, u.Upload("step/log.0", "../data/emitterdata"))
+
+	got, _ := ioutil.ReadFile(logFile.Name())
+	assert.Equal(t, want, got)
+	assert.Equal(t, want, store.uploads["step/log.0"])
+	assert.Equal(t, want, gunzip(t, store.uploads["step/log.0.gz"]))
+
+	failing := &fakeUploader{fail: true}
+	f = NewFanOutUploader(Destination{Name: "store", Uploader: failing, Required: true})
+	u, _ = NewCompressingUploader(f, EncodingGzip)
+	assert.Error(t, u.Upload("step/log.0", "../data/emitterdata"))
+}
+
+func TestLocalUploaderDecompresses(t *testing.T) {
+	want, _ := ioutil.ReadFile("../data/emitterdata")
+	logFile, _ := ioutil.TempFile("", "build.log")
+	logFile.Close()
+	defer os.Remove(logFile.Name())
+
+	u, _ := NewCompressingUploader(NewLocalUploader(logFile.Name()), EncodingGzip)
+	assert.NoError(t, u.Upload("step/log.0", "../data/emitterdata"))
+
+	got, _ := ioutil.ReadFile(logFile.Name())
+	assert.Equal(t, want, got, "the local log file should stay readable")
+}
+
+func TestNewDecompressingReader(t *testing.T) {
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	w.Write([]byte("compressed line\n"))
+	w.Close()
+
+	for _, test := range []struct {
+		input    []byte
+		encoding string
+		want     string
+	}{
+		{compressed.Bytes(), EncodingGzip, "compressed line\n"},
+		{compressed.Bytes(), "", "compressed line\n"},
+		{[]byte("plain line\n"), "", "plain line\n"},
+		{nil, "", ""},
+	} {
+		r, err := NewDecompressingReader(bytes.NewReader(test.input), test.encoding)
+		require.NoError(t, err)
+		got, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, test.want, string(got))
+	}
+
+	_, err := NewDecompressingReader(strings.NewReader(""), "zstd")
+	assert.Error(t, err)
+}
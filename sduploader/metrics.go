@@ -0,0 +1,16 @@
+package sduploader
+
+import "github.com/screwdriver-cd/log-service/metrics"
+
+// Backends that requests are counted for
+const (
+	backendStore = "store"
+	backendS3    = "s3"
+)
+
+var (
+	requestRetries = metrics.NewCounter("logservice_upload_request_retries_total",
+		"Upload requests that were retried, by backend.", "backend")
+	requestFailures = metrics.NewCounter("logservice_upload_request_failures_total",
+		"Upload requests that failed after any retries, by backend.", "backend")
+)
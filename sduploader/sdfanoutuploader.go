@@ -0,0 +1,137 @@
+package sduploader
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Destination is one of the uploaders a fan-out uploader writes to. A failed upload
+// to a Required destination fails the whole upload; failures of other destinations
+// are only logged. If Accept is set, only the paths it accepts are sent.
+type Destination struct {
+	Name     string
+	Uploader SDUploader
+	Required bool
+	Accept   func(path string) bool
+}
+
+type sdFanOutUploader struct {
+	destinations []Destination
+	mutex        sync.Mutex
+	// offsets holds how much of each path every destination has, so a destination
+	// that missed an append is sent everything it is missing next time
+	offsets []map[string]int64
+}
+
+// NewFanOutUploader returns an SDUploader that uploads every file to all destinations
+// concurrently.
+func NewFanOutUploader(destinations ...Destination) SDUploader {
+	f := &sdFanOutUploader{destinations: destinations}
+	for range destinations {
+		f.offsets = append(f.offsets, map[string]int64{})
+	}
+
+	return f
+}
+
+// Upload sends a file to every destination.
+func (f *sdFanOutUploader) Upload(path string, filePath string) error {
+	return f.UploadRange(path, filePath, 0)
+}
+
+// UploadRange sends the part of a file after offset to the destinations that can
+// append, and the whole file to those that cannot.
+func (f *sdFanOutUploader) UploadRange(path string, filePath string, offset int64) error {
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(f.destinations))
+	var wg sync.WaitGroup
+	for i, d := range f.destinations {
+		if d.Accept != nil && !d.Accept(path) {
+			continue
+		}
+
+		ru, ok := d.Uploader.(RangeUploader)
+		if !ok {
+			wg.Add(1)
+			go func(i int, d Destination) {
+				defer wg.Done()
+				errs[i] = d.Uploader.Upload(path, filePath)
+			}(i, d)
+			continue
+		}
+
+		f.mutex.Lock()
+		from, seen := f.offsets[i][path]
+		if !seen || offset == 0 {
+			// Trust the caller for files we have not sent before
+			from = offset
+		}
+		f.mutex.Unlock()
+
+		wg.Add(1)
+		go func(i int, ru RangeUploader) {
+			defer wg.Done()
+			errs[i] = ru.UploadRange(path, filePath, from)
+
+			f.mutex.Lock()
+			defer f.mutex.Unlock()
+			if errs[i] == nil {
+				f.offsets[i][path] = stat.Size()
+			} else {
+				f.offsets[i][path] = from
+			}
+		}(i, ru)
+	}
+	wg.Wait()
+
+	return f.check(filePath, errs)
+}
+
+// uploadCopies sends the compressed copy of a file to the destinations that can label
+// uploads with its encoding, and both copies to the others.
+func (f *sdFanOutUploader) uploadCopies(path string, plainPath string, compressedPath string, encoding string) error {
+	errs := make([]error, len(f.destinations))
+	var wg sync.WaitGroup
+	for i, d := range f.destinations {
+		if d.Accept != nil && !d.Accept(path) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, d Destination) {
+			defer wg.Done()
+			errs[i] = uploadCompressed(d.Uploader, path, plainPath, compressedPath, encoding)
+		}(i, d)
+	}
+	wg.Wait()
+
+	return f.check(plainPath, errs)
+}
+
+// check logs the errors of best-effort destinations and returns an error if any
+// required destination failed.
+func (f *sdFanOutUploader) check(filePath string, errs []error) error {
+	var failed []string
+	for i, d := range f.destinations {
+		if errs[i] == nil {
+			continue
+		}
+		if d.Required {
+			failed = append(failed, fmt.Sprintf("%s: %v", d.Name, errs[i]))
+		} else {
+			log.Printf("errored:[%v], uploading %q to best-effort destination %s", errs[i], filePath, d.Name)
+		}
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("uploading %q to %s", filePath, strings.Join(failed, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package sduploader
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeUploader records uploads and fails while fail is set.
+type fakeUploader struct {
+	mutex   sync.Mutex
+	fail    bool
+	uploads []string
+	offsets []int64
+}
+
+func (f *fakeUploader) Upload(path string, filePath string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.fail {
+		return errors.New("destination is down")
+	}
+	f.uploads = append(f.uploads, path)
+	return nil
+}
+
+// fakeRangeUploader is a fakeUploader that can append.
+type fakeRangeUploader struct {
+	fakeUploader
+}
+
+func (f *fakeRangeUploader) UploadRange(path string, filePath string, offset int64) error {
+	if err := f.Upload(path, filePath); err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.offsets = append(f.offsets, offset)
+	return nil
+}
+
+func TestFanOutUpload(t *testing.T) {
+	store := &fakeUploader{}
+	archive := &fakeUploader{}
+	u := NewFanOutUploader(
+		Destination{Name: "store", Uploader: store, Required: true},
+		Destination{Name: "archive", Uploader: archive},
+	)
+
+	assert.NoError(t, u.Upload("step/log.0", "../data/emitterdata"))
+	assert.Equal(t, []string{"step/log.0"}, store.uploads)
+	assert.Equal(t, []string{"step/log.0"}, archive.uploads)
+
+	archive.fail = true
+	assert.NoError(t, u.Upload("step/log.1", "../data/emitterdata"), "best-effort failures should not fail the upload")
+	assert.Equal(t, []string{"step/log.0", "step/log.1"}, store.uploads)
+
+	store.fail = true
+	err := u.Upload("step/log.2", "../data/emitterdata")
+	assert.EqualError(t, err, `uploading "../data/emitterdata" to store: destination is down`)
+}
+
+func TestFanOutUploadMissingFile(t *testing.T) {
+	u := NewFanOutUploader(Destination{Name: "store", Uploader: &fakeUploader{}, Required: true})
+
+	assert.Error(t, u.Upload("step/log.0", "does-not-exist"))
+}
+
+func TestFanOutUploadRange(t *testing.T) {
+	f, _ := ioutil.TempFile("", "fanout")
+	defer os.Remove(f.Name())
+
+	store := &fakeRangeUploader{}
+	archive := &fakeRangeUploader{}
+	plain := &fakeUploader{}
+	u := NewFanOutUploader(
+		Destination{Name: "store", Uploader: store, Required: true},
+		Destination{Name: "archive", Uploader: archive},
+		Destination{Name: "plain", Uploader: plain},
+	).(RangeUploader)
+
+	f.WriteString("first\n")
+	assert.NoError(t, u.UploadRange("step/log.0", f.Name(), 0))
+
+	// The archive misses the second append, so it is sent from where it left off
+	archive.fail = true
+	f.WriteString("second\n")
+	assert.NoError(t, u.UploadRange("step/log.0", f.Name(), 6))
+	archive.fail = false
+	f.WriteString("third\n")
+	assert.NoError(t, u.UploadRange("step/log.0", f.Name(), 13))
+
+	assert.Equal(t, []int64{0, 6, 13}, store.offsets)
+	assert.Equal(t, []int64{0, 6}, archive.offsets)
+	assert.Len(t, plain.uploads, 3, "destinations that cannot append get the whole file")
+}
+
+func TestFanOutUploadAccept(t *testing.T) {
+	store := &fakeUploader{}
+	archive := &fakeUploader{}
+	u := NewFanOutUploader(
+		Destination{Name: "store", Uploader: store, Required: true},
+		Destination{Name: "archive", Uploader: archive, Accept: func(path string) bool { return path == "step/log.0" }},
+	)
+
+	assert.NoError(t, u.Upload("step/log.0", "../data/emitterdata"))
+	assert.NoError(t, u.Upload("step/manifest.json", "../data/emitterdata"))
+	assert.Equal(t, []string{"step/log.0", "step/manifest.json"}, store.uploads)
+	assert.Equal(t, []string{"step/log.0"}, archive.uploads)
+}
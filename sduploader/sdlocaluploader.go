@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
 type sdLocalUploader struct {
@@ -80,3 +82,31 @@ func (s *sdLocalUploader) Upload(path string, filePath string) error {
 
 	return nil
 }
+
+// UploadEncoded decompresses a file and appends it to the local log file, which is
+// always kept uncompressed.
+func (s *sdLocalUploader) UploadEncoded(path string, filePath string, encoding string) error {
+	input, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	reader, err := NewDecompressingReader(input, encoding)
+	if err != nil {
+		return err
+	}
+
+	plain, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(plain.Name())
+	defer plain.Close()
+
+	if _, err := io.Copy(plain, reader); err != nil {
+		return err
+	}
+
+	return s.Upload(path, plain.Name())
+}
@@ -0,0 +1,435 @@
+package sduploader
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+const (
+	// MinS3PartSize is the smallest part S3 accepts in a multipart upload
+	MinS3PartSize = 5 << 20
+	// DefaultS3PartSize is the part size used when none is configured
+	DefaultS3PartSize = 8 << 20
+	// DefaultS3Prefix is the key prefix used when none is configured
+	DefaultS3Prefix = "builds/{build}"
+
+	s3Service   = "s3"
+	s3Algorithm = "AWS4-HMAC-SHA256"
+	amzDate     = "20060102T150405Z"
+	amzDay      = "20060102"
+)
+
+// S3Config describes an S3-compatible bucket to upload logs to. Bucket and Prefix may
+// contain {build} and {step}, which are replaced by the build ID and step name.
+type S3Config struct {
+	Endpoint     string // e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Region       string
+	Bucket       string
+	Prefix       string
+	PathStyle    bool // put the bucket in the URL path instead of the host name
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	PartSize     int64 // files larger than this are sent in a multipart upload
+}
+
+type sdS3Uploader struct {
+	buildID string
+	config  S3Config
+	client  *retryablehttp.Client
+	now     func() time.Time
+}
+
+// NewS3Uploader returns an SDUploader that writes a build's logs to an S3-compatible bucket.
+func NewS3Uploader(buildID string, config S3Config) (SDUploader, error) {
+	if len(config.Bucket) == 0 {
+		return nil, fmt.Errorf("no S3 bucket specified")
+	}
+	if len(config.Region) == 0 {
+		return nil, fmt.Errorf("no S3 region specified")
+	}
+	if len(config.AccessKey) == 0 || len(config.SecretKey) == 0 {
+		return nil, fmt.Errorf("no S3 credentials specified")
+	}
+	if len(config.Endpoint) == 0 {
+		config.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", config.Region)
+	}
+	if _, err := url.Parse(config.Endpoint); err != nil {
+		return nil, fmt.Errorf("bad S3 endpoint %s: %v", config.Endpoint, err)
+	}
+	if len(config.Prefix) == 0 {
+		config.Prefix = DefaultS3Prefix
+	}
+	if config.PartSize == 0 {
+		config.PartSize = DefaultS3PartSize
+	}
+	if config.PartSize < MinS3PartSize {
+		return nil, fmt.Errorf("S3 part size %d is below the minimum of %d", config.PartSize, MinS3PartSize)
+	}
+
+	return &sdS3Uploader{
+		buildID: buildID,
+		config:  config,
+		client:  newRetryClient(backendS3),
+		now:     time.Now,
+	}, nil
+}
+
+// s3Error is an error response from S3
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+// Error implements the error interface for s3Error
+func (e s3Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Upload sends a file to a path within the build's prefix of the bucket. The first
+// element of the path is the step name.
+func (s *sdS3Uploader) Upload(storePath string, filePath string) error {
+	return s.UploadEncoded(storePath, filePath, "")
+}
+
+// UploadEncoded is like Upload for a file that is compressed with encoding.
+func (s *sdS3Uploader) UploadEncoded(storePath string, filePath string, encoding string) error {
+	u, err := s.makeURL(storePath)
+	if err != nil {
+		return fmt.Errorf("generating url for file %q to %s: %v", filePath, storePath, err)
+	}
+
+	input, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	stat, err := input.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", contentType(storePath))
+	if len(encoding) != 0 {
+		header.Set("Content-Encoding", encoding)
+	}
+
+	if stat.Size() > s.config.PartSize {
+		err = s.multipartUpload(u, input, header)
+	} else {
+		var body []byte
+		if body, err = ioutil.ReadAll(input); err == nil {
+			_, err = s.do(http.MethodPut, u, body, header)
+		}
+	}
+	if err != nil {
+		log.Printf("errored:[%v], uploading file %q to %s", err, filePath, u)
+		return err
+	}
+
+	return nil
+}
+
+// contentType returns the content type of a file in the Store.
+func contentType(storePath string) string {
+	if path.Ext(storePath) == ".json" {
+		return "application/json"
+	}
+	return "application/x-ndjson"
+}
+
+// expand replaces the {build} and {step} placeholders in a template.
+func (s *sdS3Uploader) expand(template string, step string) string {
+	return strings.NewReplacer("{build}", s.buildID, "{step}", step).Replace(template)
+}
+
+// makeURL creates the fully-qualified url of the object for a given Store path.
+func (s *sdS3Uploader) makeURL(storePath string) (*url.URL, error) {
+	storePath = strings.TrimPrefix(storePath, "/")
+	step := strings.SplitN(storePath, "/", 2)[0]
+	key := storePath
+	if strings.Contains(s.config.Prefix, "{step}") {
+		// The prefix already names the step
+		key = strings.TrimPrefix(strings.TrimPrefix(storePath, step), "/")
+	}
+	key = path.Join(s.expand(s.config.Prefix, step), key)
+	bucket := s.expand(s.config.Bucket, step)
+
+	u, err := url.Parse(s.config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if s.config.PathStyle {
+		u.Path = path.Join("/", u.Path, bucket, key)
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = path.Join("/", u.Path, key)
+	}
+
+	return u, nil
+}
+
+// multipartUpload sends a large file in parts, aborting the upload if any part fails.
+func (s *sdS3Uploader) multipartUpload(u *url.URL, input io.Reader, header http.Header) error {
+	body, err := s.do(http.MethodPost, withQuery(u, "uploads", ""), nil, header)
+	if err != nil {
+		return fmt.Errorf("starting multipart upload: %v", err)
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &initiated); err != nil {
+		return fmt.Errorf("parsing multipart upload response: %v", err)
+	}
+	uploadURL := withQuery(u, "uploadId", initiated.UploadID)
+
+	err = s.uploadParts(uploadURL, input)
+	if err != nil {
+		if _, abortErr := s.do(http.MethodDelete, uploadURL, nil, nil); abortErr != nil {
+			log.Printf("errored:[%v], aborting multipart upload to %s", abortErr, u)
+		}
+	}
+
+	return err
+}
+
+// completedPart is a part of a multipart upload, as listed when completing it.
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// uploadParts sends the parts of a multipart upload and completes it.
+func (s *sdS3Uploader) uploadParts(uploadURL *url.URL, input io.Reader) error {
+	var parts []completedPart
+
+	buf := make([]byte, s.config.PartSize)
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(input, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		partURL := withQuery(uploadURL, "partNumber", fmt.Sprint(number))
+		res, err := s.request(http.MethodPut, partURL, buf[:n], nil)
+		if err != nil {
+			return fmt.Errorf("uploading part %d: %v", number, err)
+		}
+		parts = append(parts, completedPart{number, res.Header.Get("ETag")})
+	}
+
+	complete, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/xml")
+	body, err := s.do(http.MethodPost, uploadURL, complete, header)
+	if err != nil {
+		return fmt.Errorf("completing multipart upload: %v", err)
+	}
+
+	// S3 can report a failure to complete with a 200 response
+	if e := parseS3Error(http.StatusOK, body); len(e.Code) != 0 {
+		return fmt.Errorf("completing multipart upload: %v", e)
+	}
+
+	return nil
+}
+
+// withQuery returns a copy of u with a query parameter added.
+func withQuery(u *url.URL, key, value string) *url.URL {
+	c := *u
+	q := c.Query()
+	q.Set(key, value)
+	c.RawQuery = q.Encode()
+
+	return &c
+}
+
+// parseS3Error reads an S3 error response body.
+func parseS3Error(status int, body []byte) s3Error {
+	e := s3Error{StatusCode: status}
+	xml.Unmarshal(body, &e)
+
+	return e
+}
+
+// do sends a signed request and returns the response body.
+func (s *sdS3Uploader) do(method string, u *url.URL, payload []byte, header http.Header) ([]byte, error) {
+	res, err := s.request(method, u, payload, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.body, nil
+}
+
+// s3Response is a response from S3 with its body already read.
+type s3Response struct {
+	*http.Response
+	body []byte
+}
+
+// request sends a signed request. Responses other than 2xx are returned as errors.
+func (s *sdS3Uploader) request(method string, u *url.URL, payload []byte, header http.Header) (*s3Response, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.client.HTTPClient.CloseIdleConnections()
+
+	// Send the path exactly as it is signed
+	req.URL.RawPath = uriEncode(req.URL.Path, false)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(payload))
+	s.sign(req, payload)
+
+	res, err := s.client.StandardClient().Do(req)
+	if err != nil {
+		requestFailures.Inc(backendS3)
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response body from S3: %v", err)
+	}
+
+	if res.StatusCode/100 != 2 {
+		requestFailures.Inc(backendS3)
+		return nil, parseS3Error(res.StatusCode, body)
+	}
+
+	return &s3Response{res, body}, nil
+}
+
+// sign adds AWS Signature Version 4 headers to a request.
+func (s *sdS3Uploader) sign(req *http.Request, payload []byte) {
+	now := s.now().UTC()
+	payloadHash := sha256.Sum256(payload)
+
+	req.Header.Set("X-Amz-Date", now.Format(amzDate))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if len(s.config.SessionToken) != 0 {
+		req.Header.Set("X-Amz-Security-Token", s.config.SessionToken)
+	}
+
+	scope := strings.Join([]string{now.Format(amzDay), s.config.Region, s3Service, "aws4_request"}, "/")
+	canonical, signedHeaders := canonicalRequest(req, hex.EncodeToString(payloadHash[:]))
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{s3Algorithm, now.Format(amzDate), scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), now.Format(amzDay))
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.config.AccessKey, scope, signedHeaders, signature))
+}
+
+// canonicalRequest returns the SigV4 canonical form of a request and the list of
+// headers it signs.
+func canonicalRequest(req *http.Request, payloadHash string) (string, string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		if name == "authorization" || name == "user-agent" {
+			continue
+		}
+		headers[name] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	var params []string
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+
+	canonicalURI := uriEncode(req.URL.Path, false)
+	if len(canonicalURI) == 0 {
+		canonicalURI = "/"
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n"), signedHeaders
+}
+
+// uriEncode percent-encodes everything except unreserved characters, and slashes
+// unless encodeSlash is set, as SigV4 requires.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
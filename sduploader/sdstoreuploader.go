@@ -28,6 +28,14 @@ type SDUploader interface {
 	Upload(path string, filePath string) error
 }
 
+// RangeUploader is an SDUploader that can add the bytes of a file past offset to an
+// object it uploaded earlier, instead of sending the whole file again. An offset of
+// 0 uploads the whole file.
+type RangeUploader interface {
+	SDUploader
+	UploadRange(path string, filePath string, offset int64) error
+}
+
 type sdStoreUploader struct {
 	buildID string
 	url     string
@@ -37,7 +45,16 @@ type sdStoreUploader struct {
 
 // NewStoreUploader returns an SDUploader for a given build.
 func NewStoreUploader(buildID, url, token string) SDUploader {
-	// read config from env variables
+	return &sdStoreUploader{
+		buildID,
+		url,
+		token,
+		newRetryClient(backendStore),
+	}
+}
+
+// readRetryConfig reads the request timeout and retry overrides from env variables.
+func readRetryConfig() {
 	if strings.TrimSpace(os.Getenv("STOREAPI_TIMEOUT_SECS")) != "" {
 		storeTimeout, _ := strconv.Atoi(os.Getenv("STOREAPI_TIMEOUT_SECS"))
 		httpTimeout = time.Duration(storeTimeout) * time.Second
@@ -46,20 +63,59 @@ func NewStoreUploader(buildID, url, token string) SDUploader {
 	if strings.TrimSpace(os.Getenv("STOREAPI_MAXRETRIES")) != "" {
 		maxRetries, _ = strconv.Atoi(os.Getenv("STOREAPI_MAXRETRIES"))
 	}
+}
+
+// newRetryClient returns an HTTP client that retries failed requests, counting the
+// retries for backend. The STOREAPI_TIMEOUT_SECS and STOREAPI_MAXRETRIES overrides
+// apply to every backend.
+func newRetryClient(backend string) *retryablehttp.Client {
+	readRetryConfig()
 
 	retryClient := retryablehttp.NewClient()
+	retryClient.RequestLogHook = func(_ retryablehttp.Logger, _ *http.Request, attempt int) {
+		if attempt > 0 {
+			requestRetries.Inc(backend)
+		}
+	}
 	retryClient.RetryMax = maxRetries
 	retryClient.RetryWaitMin = time.Duration(retryWaitMin) * time.Millisecond
 	retryClient.RetryWaitMax = time.Duration(retryWaitMax) * time.Millisecond
 	retryClient.Backoff = retryablehttp.LinearJitterBackoff
 	retryClient.HTTPClient.Timeout = httpTimeout
 
-	return &sdStoreUploader{
-		buildID,
-		url,
-		token,
-		retryClient,
+	return retryClient
+}
+
+// sdAppendingStoreUploader is an sdStoreUploader for Stores that accept partial PUTs,
+// so only the bytes added to a file since its last upload are sent.
+type sdAppendingStoreUploader struct {
+	*sdStoreUploader
+}
+
+// NewAppendingStoreUploader returns a RangeUploader for a given build. The Store must
+// support PUT requests with a Content-Range header.
+func NewAppendingStoreUploader(buildID, url, token string) SDUploader {
+	return &sdAppendingStoreUploader{NewStoreUploader(buildID, url, token).(*sdStoreUploader)}
+}
+
+// UploadRange sends the part of a file after offset to be written at that offset of
+// a path within the SD Store.
+func (s *sdAppendingStoreUploader) UploadRange(storePath string, filePath string, offset int64) error {
+	if offset == 0 {
+		return s.Upload(storePath, filePath)
+	}
+
+	u, err := s.makeURL(storePath)
+	if err != nil {
+		return fmt.Errorf("generating url for file %q to %s", filePath, storePath)
 	}
+
+	err = s.putFileRange(u, "application/x-ndjson", filePath, offset)
+	if err != nil {
+		log.Printf("errored:[%v], appending file %q to %s", err, filePath, storePath)
+		return err
+	}
+	return nil
 }
 
 // SDError is an error response from the Screwdriver API
@@ -82,7 +138,12 @@ func (s *sdStoreUploader) Upload(storePath string, filePath string) error {
 		return fmt.Errorf("generating url for file %q to %s", filePath, storePath)
 	}
 
-	err = s.putFile(u, "application/x-ndjson", filePath)
+	bodyType := "application/x-ndjson"
+	if strings.HasSuffix(storePath, compressionSuffixes[EncodingGzip]) {
+		bodyType = "application/gzip"
+	}
+
+	err = s.putFile(u, bodyType, filePath)
 	if err != nil {
 		log.Printf("errored:[%v], posting file %q to %s", filePath, storePath, err)
 		return err
@@ -142,7 +203,36 @@ func (s *sdStoreUploader) putFile(url *url.URL, bodyType string, filePath string
 	return <-done
 }
 
+// putFileRange writes the bytes of a file at filePath from offset onwards to a url with
+// a partial PUT request.
+func (s *sdStoreUploader) putFileRange(url *url.URL, bodyType string, filePath string, offset int64) error {
+	input, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	stat, err := input.Stat()
+	if err != nil {
+		return err
+	}
+	fsize := stat.Size()
+	if offset >= fsize {
+		return nil
+	}
+
+	header := http.Header{}
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", offset, fsize-1))
+	_, err = s.putWithHeader(url, bodyType, io.NewSectionReader(input, offset, fsize-offset), fsize-offset, header)
+
+	return err
+}
+
 func (s *sdStoreUploader) put(url *url.URL, bodyType string, payload io.Reader, size int64) ([]byte, error) {
+	return s.putWithHeader(url, bodyType, payload, size, nil)
+}
+
+func (s *sdStoreUploader) putWithHeader(url *url.URL, bodyType string, payload io.Reader, size int64, header http.Header) ([]byte, error) {
 	req, err := http.NewRequest("PUT", url.String(), payload)
 	if err != nil {
 		return nil, err
@@ -150,6 +240,9 @@ func (s *sdStoreUploader) put(url *url.URL, bodyType string, payload io.Reader,
 
 	defer s.client.HTTPClient.CloseIdleConnections()
 
+	for k, v := range header {
+		req.Header[k] = v
+	}
 	req.Header.Set("Authorization", tokenHeader(s.token))
 	req.Header.Set("Content-Type", bodyType)
 	req.ContentLength = size
@@ -160,10 +253,12 @@ func (s *sdStoreUploader) put(url *url.URL, bodyType string, payload io.Reader,
 	}
 
 	if err != nil {
+		requestFailures.Inc(backendStore)
 		return nil, err
 	}
 
 	if res.StatusCode/100 != 2 {
+		requestFailures.Inc(backendStore)
 		return nil, fmt.Errorf("response code %d", res.StatusCode)
 	}
 
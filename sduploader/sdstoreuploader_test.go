@@ -146,6 +146,25 @@ func TestFileUploadRetry(t *testing.T) {
 	}
 }
 
+func TestFileUploadRetryMetrics(t *testing.T) {
+	retryHttpClient := newRetryClient(backendStore)
+	retryHttpClient.RetryMax = 2
+	uploader := &sdStoreUploader{
+		"testbuild",
+		"http://fakeurl",
+		"faketoken",
+		retryHttpClient,
+	}
+	uploader.client.HTTPClient = makeFakeHTTPClient(t, 500, "ERROR", func(r *http.Request) {})
+
+	retries := requestRetries.Value(backendStore)
+	failures := requestFailures.Value(backendStore)
+	err := uploader.Upload("test/path/1", testFile().Name())
+	assert.Error(t, err)
+	assert.Equal(t, retries+2, requestRetries.Value(backendStore))
+	assert.Equal(t, failures+1, requestFailures.Value(backendStore))
+}
+
 func TestNewStoreUploaderDefaults(t *testing.T) {
 	maxRetries = 5
 	httpTimeout = time.Duration(20) * time.Second
@@ -163,3 +182,48 @@ func TestNewStoreUploader(t *testing.T) {
 	assert.Equal(t, httpTimeout, time.Duration(10)*time.Second)
 	assert.Equal(t, maxRetries, 1)
 }
+
+func TestFileUploadRange(t *testing.T) {
+	testBuildID := "testbuild"
+	url := "http://fakeurl"
+	token := "faketoken"
+	testPath := "test/path/1"
+	uploader := NewAppendingStoreUploader(testBuildID, url, token).(*sdAppendingStoreUploader)
+	called := false
+
+	want := bytes.NewBuffer(nil)
+	f := testFile()
+	io.Copy(want, f)
+	f.Close()
+	offset := int64(10)
+
+	http := makeFakeHTTPClient(t, 200, "OK", func(r *http.Request) {
+		called = true
+		got := bytes.NewBuffer(nil)
+		io.Copy(got, r.Body)
+		r.Body.Close()
+
+		if got.String() != want.String()[offset:] {
+			t.Errorf("Received payload %s, want %s", got, want.String()[offset:])
+		}
+
+		if r.Method != "PUT" {
+			t.Errorf("Uploaded with method %s, want PUT", r.Method)
+		}
+
+		wantRange := fmt.Sprintf("bytes %d-%d/*", offset, want.Len()-1)
+		validateHeader(t, "Content-Range", wantRange)(r)
+
+		if r.ContentLength != int64(want.Len())-offset {
+			t.Errorf("Wrong Content-Length sent to uploader. Got %d, want %d", r.ContentLength, int64(want.Len())-offset)
+		}
+	})
+	uploader.client.HTTPClient = http
+	if err := uploader.UploadRange(testPath, testFile().Name(), offset); err != nil {
+		t.Fatalf("Unexpected error from UploadRange: %v", err)
+	}
+
+	if !called {
+		t.Fatalf("The HTTP client was never used.")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	secretPlaceholder = "***"
+	minSecretLength   = 3
+	// minSplitLength is the shortest piece of a secret split across lines that we match
+	minSplitLength = 2
+	// maxSecretHold is how long a line is held back waiting for the rest of a secret
+	// before it is stored as it is
+	maxSecretHold = 30 * time.Second
+)
+
+// secretMasker replaces known secret values in log messages with a placeholder.
+type secretMasker struct {
+	// variants are every form of every secret we look for, longest first
+	variants []string
+}
+
+// newSecretMasker returns a secretMasker for secrets and their base64 and URL-encoded forms.
+// Secrets shorter than minSecretLength are ignored, since masking them would mangle
+// ordinary output.
+func newSecretMasker(secrets []string) *secretMasker {
+	seen := map[string]bool{}
+	m := &secretMasker{}
+
+	for _, secret := range secrets {
+		if len(secret) < minSecretLength {
+			continue
+		}
+
+		for _, v := range []string{
+			secret,
+			base64.StdEncoding.EncodeToString([]byte(secret)),
+			base64.RawStdEncoding.EncodeToString([]byte(secret)),
+			base64.URLEncoding.EncodeToString([]byte(secret)),
+			base64.RawURLEncoding.EncodeToString([]byte(secret)),
+			url.QueryEscape(secret),
+			url.PathEscape(secret),
+		} {
+			if !seen[v] {
+				seen[v] = true
+				m.variants = append(m.variants, v)
+			}
+		}
+	}
+
+	sort.SliceStable(m.variants, func(i, j int) bool {
+		return len(m.variants[i]) > len(m.variants[j])
+	})
+
+	return m
+}
+
+// loadSecrets reads secret values from a file with one secret per line, and from the
+// environment variables named in envNames.
+func loadSecrets(file string, envNames []string) ([]string, error) {
+	var secrets []string
+
+	if len(file) != 0 {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("opening secrets file %s: %v", file, err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := scanner.Text(); len(line) != 0 {
+				secrets = append(secrets, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading secrets file %s: %v", file, err)
+		}
+	}
+
+	for _, name := range envNames {
+		if value := os.Getenv(strings.TrimSpace(name)); len(value) != 0 {
+			secrets = append(secrets, value)
+		}
+	}
+
+	return secrets, nil
+}
+
+// Mask replaces every secret in message, returning the result and the number of
+// secrets replaced.
+func (m *secretMasker) Mask(message string) (string, int) {
+	count := 0
+	for _, v := range m.variants {
+		if n := strings.Count(message, v); n > 0 {
+			count += n
+			message = strings.ReplaceAll(message, v, secretPlaceholder)
+		}
+	}
+
+	return message, count
+}
+
+// MaskSplit masks a secret that starts at the end of first and continues at the start
+// of second, returning both messages and the number of secrets replaced.
+func (m *secretMasker) MaskSplit(first, second string) (string, string, int) {
+	for _, v := range m.variants {
+		for k := len(v) - minSplitLength; k >= minSplitLength; k-- {
+			if strings.HasSuffix(first, v[:k]) && strings.HasPrefix(second, v[k:]) {
+				return first[:len(first)-k] + secretPlaceholder, secretPlaceholder + second[len(v)-k:], 1
+			}
+		}
+	}
+
+	return first, second, 0
+}
+
+// EndsWithPartialSecret returns true if message ends with the beginning of a secret,
+// meaning the rest of it could be at the start of the next line.
+func (m *secretMasker) EndsWithPartialSecret(message string) bool {
+	for _, v := range m.variants {
+		for k := len(v) - minSplitLength; k >= minSplitLength; k-- {
+			if strings.HasSuffix(message, v[:k]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// lineRedactor masks the secrets in the lines of a single step. A line that ends with
+// the beginning of a secret is held back until the next line arrives, so a secret
+// split across the two is masked in both.
+type lineRedactor struct {
+	masker       *secretMasker
+	pending      *logLine
+	pendingSince time.Time
+	count        int
+}
+
+// Redact masks secrets in a line and returns the lines that are ready to be stored.
+// Escape sequences in the line are ignored, so they cannot hide a secret.
+func (r *lineRedactor) Redact(l *logLine) []*logLine {
+	line := *l
+	line.Message = maskPlain(line.Message, func(text string) string {
+		masked, n := r.masker.Mask(text)
+		r.count += n
+		return masked
+	})
+
+	var ready []*logLine
+	if r.pending != nil {
+		r.pending.Message, line.Message = r.maskSplit(r.pending.Message, line.Message)
+		ready = append(ready, r.pending)
+		r.pending = nil
+	}
+
+	if r.masker.EndsWithPartialSecret(plainText(line.Message)) {
+		r.pending = &line
+		r.pendingSince = time.Now()
+	} else {
+		ready = append(ready, &line)
+	}
+
+	return ready
+}
+
+// maskSplit masks a secret that starts at the end of first and continues at the start
+// of second, looking at their text without escape sequences. Both are returned as
+// plain text if a secret is masked.
+func (r *lineRedactor) maskSplit(first, second string) (string, string) {
+	maskedFirst, maskedSecond, n := r.masker.MaskSplit(plainText(first), plainText(second))
+	if n == 0 {
+		return first, second
+	}
+	r.count += n
+
+	return maskedFirst, maskedSecond
+}
+
+// Flush returns the line being held back, if any.
+func (r *lineRedactor) Flush() []*logLine {
+	if r.pending == nil {
+		return nil
+	}
+
+	ready := []*logLine{r.pending}
+	r.pending = nil
+
+	return ready
+}
+
+// FlushStale returns the line being held back if it arrived before since.
+func (r *lineRedactor) FlushStale(since time.Time) []*logLine {
+	if r.pending == nil || !r.pendingSince.Before(since) {
+		return nil
+	}
+
+	return r.Flush()
+}
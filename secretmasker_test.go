@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMaskSecrets(t *testing.T) {
+	secret := "s3cr3t/p@ss"
+	m := newSecretMasker([]string{secret, "ab"})
+
+	tests := []struct {
+		message   string
+		want      string
+		wantCount int
+	}{
+		{"nothing to see here", "nothing to see here", 0},
+		{"password=" + secret, "password=***", 1},
+		{secret + " and " + secret, "*** and ***", 2},
+		{"b64 " + base64.StdEncoding.EncodeToString([]byte(secret)), "b64 ***", 1},
+		{"url ?p=" + url.QueryEscape(secret), "url ?p=***", 1},
+		{"short secrets like ab are ignored", "short secrets like ab are ignored", 0},
+	}
+
+	for _, tt := range tests {
+		got, count := m.Mask(tt.message)
+		if got != tt.want || count != tt.wantCount {
+			t.Errorf("Mask(%q) = %q, %d, want %q, %d", tt.message, got, count, tt.want, tt.wantCount)
+		}
+	}
+}
+
+func TestRedactSplitSecret(t *testing.T) {
+	r := &lineRedactor{masker: newSecretMasker([]string{"hunter2hunter2"})}
+
+	ready := r.Redact(&logLine{Time: 1, Message: "token: hunter2h", Step: testStepName})
+	if len(ready) != 0 {
+		t.Fatalf("A line ending with part of a secret should be held back. Got %v", ready)
+	}
+
+	ready = r.Redact(&logLine{Time: 2, Message: "unter2 done", Step: testStepName})
+	var got []string
+	for _, l := range ready {
+		got = append(got, l.Message)
+	}
+	want := []string{"token: ***", "*** done"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Redacted lines = %q, want %q", got, want)
+	}
+	if r.count != 1 {
+		t.Errorf("Redaction count = %d, want 1", r.count)
+	}
+
+	ready = r.Redact(&logLine{Time: 3, Message: "almost hunter2hu", Step: testStepName})
+	if len(ready) != 0 {
+		t.Fatalf("A line ending with part of a secret should be held back. Got %v", ready)
+	}
+	ready = r.Flush()
+	if len(ready) != 1 || ready[0].Message != "almost hunter2hu" {
+		t.Errorf("Flush() = %v, want the held back line", ready)
+	}
+	if r.Flush() != nil {
+		t.Errorf("Nothing should be left to flush")
+	}
+
+	r.Redact(&logLine{Time: 4, Message: "almost hunter2hu", Step: testStepName})
+	if ready := r.FlushStale(time.Now().Add(-time.Second)); ready != nil {
+		t.Errorf("FlushStale() = %v, want a line that just arrived to stay held back", ready)
+	}
+	if ready := r.FlushStale(time.Now().Add(time.Second)); len(ready) != 1 {
+		t.Errorf("FlushStale() = %v, want the line held back since before", ready)
+	}
+}
+
+func TestRedactColoredSecret(t *testing.T) {
+	r := &lineRedactor{masker: newSecretMasker([]string{"hunter2hunter2"})}
+
+	ready := r.Redact(&logLine{Time: 1, Message: "token: \x1b[33mhunter2\x1b[0mhunter2", Step: testStepName})
+	if len(ready) != 1 || ready[0].Message != "token: ***" {
+		t.Errorf("Redact() = %v, want the colored secret masked", ready)
+	}
+
+	// The first half of the secret is followed by a color reset
+	if ready := r.Redact(&logLine{Time: 2, Message: "token: \x1b[33mhunter2\x1b[0m", Step: testStepName}); len(ready) != 0 {
+		t.Fatalf("A line ending with part of a secret should be held back. Got %v", ready)
+	}
+	ready = r.Redact(&logLine{Time: 3, Message: "\x1b[33mhunter2\x1b[0m done", Step: testStepName})
+	var got []string
+	for _, l := range ready {
+		got = append(got, l.Message)
+	}
+	if want := []string{"token: ***", "*** done"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Redacted lines = %q, want %q", got, want)
+	}
+}
+
+func TestWriteLogMasksSecretAcrossTick(t *testing.T) {
+	s := newTestStepSaver()
+	s.redactor = &lineRedactor{masker: newSecretMasker([]string{"letmein"})}
+
+	s.WriteLog(&logLine{Time: 1234, Message: "password is let", Step: "step1"})
+	// The save ticker fires before the rest of the secret arrives
+	if err := s.flushStale(time.Now()); err != nil {
+		t.Fatalf("Unexpected error flushing: %v", err)
+	}
+	s.WriteLog(&logLine{Time: 2345, Message: "mein", Step: "step1"})
+	s.flush()
+
+	got, _ := s.LogFiles()[0].Contents()
+	want := `{"t":1234,"m":"password is ***","n":0,"s":"step1"}` + "\n" +
+		`{"t":2345,"m":"***","n":1,"s":"step1"}` + "\n"
+	if string(got) != want {
+		t.Errorf("log file = %s, want %s", got, want)
+	}
+
+	// A line is not held back forever
+	s.WriteLog(&logLine{Time: 3456, Message: "let", Step: "step1"})
+	s.flushStale(time.Now().Add(maxSecretHold + time.Second))
+	if s.lineCount != 3 {
+		t.Errorf("stepSaver.lineCount = %d after the held back line went stale, want 3", s.lineCount)
+	}
+	s.LogFiles()[0].Close()
+}
+
+func TestLoadSecrets(t *testing.T) {
+	f, err := ioutil.TempFile("", "secrets")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("first\n\nsecond\n")
+	f.Close()
+
+	os.Setenv("TEST_LOG_SECRET", "third")
+	defer os.Unsetenv("TEST_LOG_SECRET")
+
+	got, err := loadSecrets(f.Name(), []string{"TEST_LOG_SECRET", " UNSET_LOG_SECRET"})
+	if err != nil {
+		t.Fatalf("Unexpected error loading secrets: %v", err)
+	}
+	want := []string{"first", "second", "third"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadSecrets() = %v, want %v", got, want)
+	}
+
+	if _, err := loadSecrets("/does/not/exist", nil); err == nil {
+		t.Errorf("Expected an error loading a missing secrets file")
+	}
+}
+
+func TestWriteLogMasksSecrets(t *testing.T) {
+	s := newTestStepSaver()
+	s.redactor = &lineRedactor{masker: newSecretMasker([]string{"letmein"})}
+
+	s.WriteLog(&logLine{Time: 1234, Message: "password is letmein", Step: "step1"})
+	s.WriteLog(&logLine{Time: 2345, Message: "password is let", Step: "step1"})
+	if s.lineCount != 1 {
+		t.Errorf("stepSaver.lineCount should be 1 while a line is held back. Got %d", s.lineCount)
+	}
+	s.flush()
+
+	got, err := s.LogFiles()[0].Contents()
+	if err != nil {
+		t.Fatalf("Couldn't read log file: %v", err)
+	}
+	want := `{"t":1234,"m":"password is ***","n":0,"s":"step1"}` + "\n" +
+		`{"t":2345,"m":"password is let","n":1,"s":"step1"}` + "\n"
+	if string(got) != want {
+		t.Errorf("log file = %s, want %s", got, want)
+	}
+	s.LogFiles()[0].Close()
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/screwdriver-cd/log-service/sduploader"
+)
+
+const journalFile = "journal.json"
+
+// spool keeps the log files of each step at fixed places on disk, along with a journal
+// of what has been uploaded, so a log service that is restarted can finish uploading
+// them and continue each step's line numbers instead of starting again from zero.
+type spool struct {
+	dir          string
+	linesPerFile int
+}
+
+// stepJournal records the state of a step in the spool. Chunks describe the log files
+// as of their last upload. Lines and Tail are only set once the step is closed, since
+// until then the log files themselves are the record of what was written. Cutoff
+// holds the last lines of an open step that reached a quota, which are not in the
+// log files yet. Findings are the likely credentials found in the step so far.
+type stepJournal struct {
+	Step         string              `json:"step"`
+	LinesPerFile int                 `json:"linesPerFile"`
+	Chunks       []chunkInfo         `json:"chunks"`
+	Closed       bool                `json:"closed"`
+	Lines        int                 `json:"lines,omitempty"`
+	Tail         []byte              `json:"tail,omitempty"`
+	Cutoff       *cutoffJournal      `json:"cutoff,omitempty"`
+	Findings     []credentialFinding `json:"findings,omitempty"`
+}
+
+// recoveredStep is where a step stood when an earlier log service stopped. An open
+// step may still have lines to upload.
+type recoveredStep struct {
+	step       string
+	checkpoint stepCheckpoint
+	open       bool
+}
+
+// newSpool returns a spool in dir, creating it if necessary.
+func newSpool(dir string, linesPerFile int) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating spool %s: %v", dir, err)
+	}
+
+	return &spool{dir: dir, linesPerFile: linesPerFile}, nil
+}
+
+// stepDir returns the directory holding the files of a step.
+func (sp *spool) stepDir(step string) string {
+	return filepath.Join(sp.dir, url.PathEscape(step))
+}
+
+// createFile creates an empty log file for a step, replacing any earlier one.
+func (sp *spool) createFile(step string, name string) (*os.File, error) {
+	dir := sp.stepDir(step)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// writeJournal atomically replaces the journal of a step.
+func (sp *spool) writeJournal(j stepJournal) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("marshaling journal for step %s: %v", j.Step, err)
+	}
+
+	dir := sp.stepDir(j.Step)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(dir, journalFile)
+	if err != nil {
+		return fmt.Errorf("creating journal for step %s: %v", j.Step, err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("writing journal for step %s: %v", j.Step, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("syncing journal for step %s: %v", j.Step, err)
+	}
+
+	return os.Rename(file.Name(), filepath.Join(dir, journalFile))
+}
+
+// Recover reads every step in the spool. Full log files that were not completely
+// uploaded are uploaded with uploader; the last log file of an open step is left in
+// its checkpoint for the step to upload once it is resumed.
+func (sp *spool) Recover(uploader sduploader.SDUploader) ([]recoveredStep, error) {
+	dirs, err := ioutil.ReadDir(sp.dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading spool %s: %v", sp.dir, err)
+	}
+
+	var recovered []recoveredStep
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		step, err := url.PathUnescape(d.Name())
+		if err != nil {
+			continue
+		}
+
+		r, err := sp.recoverStep(uploader, step)
+		if err != nil {
+			log.Printf("ERROR: recovering step %s: %v", step, err)
+			continue
+		}
+		if r != nil {
+			recovered = append(recovered, *r)
+		}
+	}
+
+	return recovered, nil
+}
+
+// recoverStep reads a single step from the spool, returning nil if it has nothing to
+// recover.
+func (sp *spool) recoverStep(uploader sduploader.SDUploader, step string) (*recoveredStep, error) {
+	dir := sp.stepDir(step)
+
+	j := stepJournal{Step: step, LinesPerFile: sp.linesPerFile}
+	data, err := ioutil.ReadFile(filepath.Join(dir, journalFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &j); err != nil {
+			return nil, fmt.Errorf("parsing journal: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading journal: %v", err)
+	}
+
+	if j.LinesPerFile != sp.linesPerFile {
+		return nil, fmt.Errorf("step was written with %d lines per file, not %d", j.LinesPerFile, sp.linesPerFile)
+	}
+
+	if j.Closed {
+		return &recoveredStep{
+			step:       step,
+			checkpoint: stepCheckpoint{lineCount: j.Lines, chunks: j.Chunks, tail: j.Tail, findings: j.Findings},
+		}, nil
+	}
+
+	saved := map[int]chunkInfo{}
+	last := -1
+	for _, c := range j.Chunks {
+		saved[c.Index] = c
+		if c.Index > last {
+			last = c.Index
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if i, err := strconv.Atoi(strings.TrimPrefix(f.Name(), "log.")); err == nil && strings.HasPrefix(f.Name(), "log.") && i > last {
+			last = i
+		}
+	}
+	if last < 0 && j.Cutoff == nil {
+		return nil, nil
+	}
+
+	cp := stepCheckpoint{cutoff: j.Cutoff, findings: j.Findings}
+	for i := 0; i <= last; i++ {
+		info, ok := saved[i]
+		if !ok {
+			info = chunkInfo{Index: i}
+		}
+
+		file := filepath.Join(dir, fmt.Sprintf("log.%d", i))
+		contents, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			// Only full chunks that were already uploaded are not kept in the spool
+			cp.lineCount += sp.linesPerFile
+			cp.chunks = append(cp.chunks, info)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Drop a line that was only partly written when the log service stopped
+		contents = contents[:bytes.LastIndexByte(contents, '\n')+1]
+		lines := bytes.Count(contents, []byte("\n"))
+		cp.lineCount += lines
+
+		if i == last && lines < sp.linesPerFile {
+			cp.tail = contents
+			cp.chunks = append(cp.chunks, info)
+			break
+		}
+
+		if int64(len(contents)) > info.Size {
+			if info, err = sp.upload(uploader, step, i, contents, info); err != nil {
+				return nil, err
+			}
+		}
+		cp.chunks = append(cp.chunks, info)
+		// The chunk is fully uploaded, so the resumed step will not need it
+		if err := os.Remove(file); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Recovered step %s at line %d from spool", step, cp.lineCount)
+
+	return &recoveredStep{step: step, checkpoint: cp, open: true}, nil
+}
+
+// upload finishes uploading a full chunk of a step, returning its new description.
+func (sp *spool) upload(uploader sduploader.SDUploader, step string, index int, contents []byte, saved chunkInfo) (chunkInfo, error) {
+	lf, err := newLogFile(uploader, sp.dir, path.Join(step, fmt.Sprintf("log.%d", index)))
+	if err != nil {
+		return saved, err
+	}
+	defer lf.Close()
+
+	if err := lf.restore(contents, saved, index*sp.linesPerFile); err != nil {
+		return saved, err
+	}
+	if err := lf.Save(); err != nil {
+		return saved, fmt.Errorf("uploading log #%d: %v", index, err)
+	}
+
+	return lf.SavedInfo(), nil
+}
+
+// Remove deletes the spool.
+func (sp *spool) Remove() error {
+	return os.RemoveAll(sp.dir)
+}
+
+// saveJournal records the state of the step in the spool. Once the step is closed,
+// its journal no longer changes.
+func (s *stepSaver) saveJournal(closed bool) error {
+	s.journalMutex.Lock()
+	defer s.journalMutex.Unlock()
+
+	if s.journalClosed {
+		return nil
+	}
+
+	j := stepJournal{
+		Step:         s.StepName,
+		LinesPerFile: s.linesPerFile,
+		Chunks:       s.chunks(false),
+		Cutoff:       s.journalCutoff(),
+		Findings:     s.journalFindings(),
+	}
+	if closed {
+		j.Closed = true
+		j.Lines = s.checkpoint.lineCount
+		j.Chunks = s.checkpoint.chunks
+		j.Tail = s.checkpoint.tail
+		j.Cutoff = nil
+		j.Findings = s.checkpoint.findings
+	}
+
+	if err := s.options.spool.writeJournal(j); err != nil {
+		return err
+	}
+	s.journalClosed = closed
+
+	return nil
+}
+
+// journalFindings returns the likely credentials found in the step so far.
+func (s *stepSaver) journalFindings() []credentialFinding {
+	if s.scanner == nil {
+		return nil
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	return append([]credentialFinding{}, s.scanner.findings...)
+}
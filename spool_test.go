@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// crashedStepSaver writes lines to a spooled StepSaver and abandons it without
+// closing it, as if the log service was killed.
+func crashedStepSaver(t *testing.T, sp *spool, uploader *manifestUploader, step string, saved, unsaved int) {
+	s := NewStepSaver(step, uploader, 3, MockAPI{}, sp.dir, stepOptions{spool: sp}).(*stepSaver)
+	s.ticker.Stop()
+
+	for i := 0; i < saved+unsaved; i++ {
+		if i == saved {
+			if err := s.Save(); err != nil {
+				t.Fatalf("Unexpected error saving: %v", err)
+			}
+		}
+		if err := s.WriteLog(&logLine{Time: int64(i), Message: fmt.Sprintf("%s #%d", step, i), Step: step}); err != nil {
+			t.Fatalf("Unexpected error writing: %v", err)
+		}
+	}
+}
+
+func storedLines(step string, from, to int) string {
+	var lines string
+	for i := from; i < to; i++ {
+		lines += fmt.Sprintf(`{"t":%d,"m":"%s #%d","n":%d,"s":"%s"}`+"\n", i, step, i, i, step)
+	}
+	return lines
+}
+
+func TestSpoolRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("Unexpected error creating spool dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	uploader := &manifestUploader{uploads: map[string][]string{}}
+	sp, _ := newSpool(dir, 3)
+	crashedStepSaver(t, sp, uploader, "A", 7, 2)
+	crashedStepSaver(t, sp, uploader, "B", 1, 1)
+
+	// The last line of B was only partly written
+	f, _ := os.OpenFile(filepath.Join(sp.stepDir("B"), "log.0"), os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"t":2,"m":"B #`)
+	f.Close()
+
+	restarted, _ := newSpool(dir, 3)
+	recovered, err := restarted.Recover(uploader)
+	if err != nil {
+		t.Fatalf("Unexpected error recovering: %v", err)
+	}
+	if len(recovered) != 2 || recovered[0].step != "A" || recovered[1].step != "B" {
+		t.Fatalf("Recovered %+v, want steps A and B", recovered)
+	}
+	if cp := recovered[0].checkpoint; cp.lineCount != 9 || len(cp.tail) != 0 || !recovered[0].open {
+		t.Errorf("Step A recovered at line %d with a %d byte tail, want line 9 and no tail", cp.lineCount, len(cp.tail))
+	}
+	if got, want := uploader.last("A/log.2"), storedLines("A", 6, 9); got != want {
+		t.Errorf("A/log.2 = %q, want the full chunk %q uploaded on recovery", got, want)
+	}
+	if cp := recovered[1].checkpoint; cp.lineCount != 2 || string(cp.tail) != storedLines("B", 0, 2) {
+		t.Errorf("Step B recovered at line %d with tail %q, want line 2 and its two lines", cp.lineCount, cp.tail)
+	}
+
+	var mutex sync.Mutex
+	gotLines := map[string]int{}
+	api := MockAPI{
+		updateStepLines: func(stepName string, lineCount int) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			gotLines[stepName] = lineCount
+			return nil
+		},
+	}
+	registry := newStepRegistry(func(step string) StepSaver {
+		return NewStepSaver(step, uploader, 3, api, dir, stepOptions{spool: restarted})
+	}, 0)
+	for _, r := range recovered {
+		if err := registry.Recover(r.step, r.checkpoint, r.open); err != nil {
+			t.Fatalf("Unexpected error recovering step %s: %v", r.step, err)
+		}
+	}
+	if got, want := uploader.last("B/log.0"), storedLines("B", 0, 2); got != want {
+		t.Errorf("B/log.0 = %q, want %q uploaded when the step was recovered", got, want)
+	}
+	if want := map[string]int{"A": 9, "B": 2}; !reflect.DeepEqual(gotLines, want) {
+		t.Errorf("UpdateStepLines got %v, want %v", gotLines, want)
+	}
+
+	// Numbering continues where the crashed log service stopped
+	registry.WriteLog(&logLine{Time: 2, Message: "B #2", Step: "B"})
+	if err := registry.Close(); err != nil {
+		t.Fatalf("Unexpected error closing registry: %v", err)
+	}
+	if got, want := uploader.last("B/log.0"), storedLines("B", 0, 3); got != want {
+		t.Errorf("B/log.0 = %q, want %q", got, want)
+	}
+
+	// Closed steps are recovered from their journals alone
+	recovered, _ = restarted.Recover(uploader)
+	if len(recovered) != 2 || recovered[0].open || recovered[1].checkpoint.lineCount != 3 {
+		t.Errorf("Recovered %+v, want closed steps A and B with B at line 3", recovered)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*", "log.*")); len(files) != 0 {
+		t.Errorf("Log files %v should be removed once their steps are closed", files)
+	}
+}
+
+func TestSpoolRecoverLinesPerFileMismatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	uploader := &manifestUploader{uploads: map[string][]string{}}
+	sp, _ := newSpool(dir, 3)
+	crashedStepSaver(t, sp, uploader, "A", 0, 1)
+
+	restarted, _ := newSpool(dir, 1000)
+	if recovered, _ := restarted.Recover(uploader); len(recovered) != 0 {
+		t.Errorf("Recovered %+v, want steps written with other settings to be skipped", recovered)
+	}
+}
+
+func TestSpoolRecoverCutoff(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	uploader := &manifestUploader{uploads: map[string][]string{}}
+	sp, _ := newSpool(dir, 3)
+	options := stepOptions{spool: sp, stepMaxLines: 2, quotaTail: 2}
+	s := NewStepSaver("A", uploader, 3, MockAPI{}, dir, options).(*stepSaver)
+	s.ticker.Stop()
+	for i := 0; i < 5; i++ {
+		s.WriteLog(&logLine{Time: int64(i), Message: fmt.Sprintf("A #%d", i), Step: "A"})
+	}
+	if err := s.Save(); err != nil {
+		t.Fatalf("Unexpected error saving: %v", err)
+	}
+
+	// The last lines kept after the quota are only in the journal
+	restarted, _ := newSpool(dir, 3)
+	recovered, err := restarted.Recover(uploader)
+	if err != nil || len(recovered) != 1 || recovered[0].checkpoint.cutoff == nil {
+		t.Fatalf("Recovered %+v, %v, want step A with its cutoff", recovered, err)
+	}
+
+	options.spool = restarted
+	registry := newStepRegistry(func(step string) StepSaver {
+		return NewStepSaver(step, uploader, 3, MockAPI{}, dir, options)
+	}, 0)
+	if err := registry.Recover("A", recovered[0].checkpoint, recovered[0].open); err != nil {
+		t.Fatalf("Unexpected error recovering step A: %v", err)
+	}
+
+	if got := uploader.last("A/log.0"); !strings.HasPrefix(got, storedLines("A", 0, 2)) || !strings.Contains(got, "[log-service] 1 lines") {
+		t.Errorf("A/log.0 = %q, want the first two lines and the cutoff marker", got)
+	}
+	if got, want := uploader.last("A/log.1"), storedLines("A", 3, 5); got != want {
+		t.Errorf("A/log.1 = %q, want the last lines %q", got, want)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stepRegistry keeps a live StepSaver for every step that is currently emitting logs,
+// so lines from steps that run concurrently can be interleaved in the same stream.
+// When a closed step reappears, its new StepSaver resumes where the old one left off.
+// A sequential registry expects steps to run one after another, and starts closing the
+// live steps in the background as soon as another step starts.
+type stepRegistry struct {
+	newStepSaver func(step string) StepSaver
+	idleTimeout  time.Duration
+	sequential   bool
+	mutex        sync.Mutex
+	steps        map[string]*liveStep
+	closingSteps map[string]chan struct{}
+	checkpoints  map[string]stepCheckpoint
+	unfinished   map[string]bool // steps closed without a checkpoint
+	closing      sync.WaitGroup
+	done         chan struct{}
+}
+
+// resumableStepSaver is a StepSaver that can pick up a step where an earlier
+// StepSaver for the same step left off.
+type resumableStepSaver interface {
+	StepSaver
+	Checkpoint() (stepCheckpoint, bool)
+	Resume(cp stepCheckpoint) error
+}
+
+// liveStep is a StepSaver along with the last time it was written to, and how many
+// lines are being written to it.
+type liveStep struct {
+	saver     StepSaver
+	lastWrite time.Time
+	writing   int
+}
+
+// newStepRegistry creates a stepRegistry that makes StepSavers with newStepSaver.
+// If idleTimeout is positive, steps that receive no lines for that long are closed.
+func newStepRegistry(newStepSaver func(step string) StepSaver, idleTimeout time.Duration) *stepRegistry {
+	r := &stepRegistry{
+		newStepSaver: newStepSaver,
+		idleTimeout:  idleTimeout,
+		steps:        map[string]*liveStep{},
+		closingSteps: map[string]chan struct{}{},
+		checkpoints:  map[string]stepCheckpoint{},
+		unfinished:   map[string]bool{},
+		done:         make(chan struct{}),
+	}
+
+	if idleTimeout > 0 {
+		go r.closeIdleLoop()
+	}
+
+	return r
+}
+
+// closeIdleLoop periodically closes steps that have gone idle until the registry is closed.
+func (r *stepRegistry) closeIdleLoop() {
+	ticker := time.NewTicker(r.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			r.closeIdle(now)
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// WriteLog routes a log line to the StepSaver for its step, starting one if necessary.
+func (r *stepRegistry) WriteLog(l *logLine) error {
+	if r.sequential {
+		r.closeOthers(l.Step)
+	}
+
+	r.mutex.Lock()
+
+	// A step that is still being closed has to finish first so we know where it left off
+	for closing, ok := r.closingSteps[l.Step]; ok; closing, ok = r.closingSteps[l.Step] {
+		r.mutex.Unlock()
+		<-closing
+		r.mutex.Lock()
+	}
+
+	s, ok := r.steps[l.Step]
+	if !ok {
+		saver, err := r.startStep(l.Step)
+		if err != nil {
+			r.mutex.Unlock()
+			return err
+		}
+		s = &liveStep{saver: saver}
+		r.steps[l.Step] = s
+		activeSteps.Inc()
+	}
+	s.lastWrite = time.Now()
+	s.writing++
+	r.mutex.Unlock()
+
+	// The registry is not locked while writing, which may wait on an upload
+	err := s.saver.WriteLog(l)
+
+	r.mutex.Lock()
+	s.writing--
+	r.mutex.Unlock()
+
+	return err
+}
+
+// startStep makes a StepSaver for a step, resuming it if the step was closed before.
+func (r *stepRegistry) startStep(step string) (StepSaver, error) {
+	saver := r.newStepSaver(step)
+
+	cp, seen := r.checkpoints[step]
+	if !seen {
+		log.Println("Starting step processing for", step)
+		return saver, nil
+	}
+
+	log.Println("Resuming step processing for", step)
+	if rs, ok := saver.(resumableStepSaver); ok {
+		if err := rs.Resume(cp); err != nil {
+			saver.Close()
+			return nil, err
+		}
+	}
+
+	return saver, nil
+}
+
+// Recover restores where a step left off before the log service was restarted. A
+// step that was still open is resumed and closed again, to upload what it had not.
+func (r *stepRegistry) Recover(step string, cp stepCheckpoint, open bool) error {
+	r.mutex.Lock()
+	r.checkpoints[step] = cp
+	if !open {
+		r.mutex.Unlock()
+		return nil
+	}
+
+	saver, err := r.startStep(step)
+	if err == nil {
+		r.steps[step] = &liveStep{saver: saver, lastWrite: time.Now()}
+		activeSteps.Inc()
+	}
+	r.mutex.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("resuming recovered step %s: %v", step, err)
+	}
+
+	return r.CloseStep(step)
+}
+
+// closeOthers closes, in the background, every live step other than step. A step that
+// fails to close is only logged, so it cannot hold up the steps after it.
+func (r *stepRegistry) closeOthers(step string) {
+	for _, other := range r.Steps() {
+		if other == step {
+			continue
+		}
+
+		s, closing := r.remove(other, time.Time{})
+		if s == nil {
+			continue
+		}
+		r.closing.Add(1)
+		go func(step string) {
+			defer r.closing.Done()
+			if err := r.finishClose(step, s, closing); err != nil {
+				log.Printf("ERROR: %v", err)
+			}
+		}(other)
+	}
+}
+
+// remove takes a live step out of the registry and marks it as closing, returning its
+// StepSaver and a channel to close once it is closed. If idleSince is set, a step that
+// was written to after it, or is being written to, is left alone.
+func (r *stepRegistry) remove(step string, idleSince time.Time) (StepSaver, chan struct{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s, ok := r.steps[step]
+	if !ok || !idleSince.IsZero() && (s.lastWrite.After(idleSince) || s.writing > 0) {
+		return nil, nil
+	}
+	delete(r.steps, step)
+	activeSteps.Dec()
+
+	closing := make(chan struct{})
+	r.closingSteps[step] = closing
+
+	return s.saver, closing
+}
+
+// CloseStep explicitly closes the StepSaver for a step. A later line for the same
+// step starts a new StepSaver that continues from where this one stopped.
+func (r *stepRegistry) CloseStep(step string) error {
+	return r.closeStep(step, time.Time{})
+}
+
+// closeStep closes the StepSaver for a step, unless idleSince is set and the step was
+// written to after it.
+func (r *stepRegistry) closeStep(step string, idleSince time.Time) error {
+	s, closing := r.remove(step, idleSince)
+	if s == nil {
+		return nil
+	}
+
+	return r.finishClose(step, s, closing)
+}
+
+// finishClose closes the StepSaver of a step taken out of the registry by remove, and
+// records where it left off.
+func (r *stepRegistry) finishClose(step string, s StepSaver, closing chan struct{}) error {
+	err := s.Close()
+
+	r.mutex.Lock()
+	if rs, ok := s.(resumableStepSaver); !ok {
+		r.checkpoints[step] = stepCheckpoint{}
+	} else if cp, ok := rs.Checkpoint(); ok {
+		r.checkpoints[step] = cp
+	} else {
+		log.Printf("WARNING: step %s was closed without a checkpoint", step)
+		r.unfinished[step] = true
+	}
+	delete(r.closingSteps, step)
+	close(closing)
+	r.mutex.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("step %s encountered errors on final save: %v", step, err)
+	}
+
+	return nil
+}
+
+// closeIdle closes, in the background, every step that has not been written to within
+// the idle timeout as of now. A step that is written to before it is closed stays open.
+func (r *stepRegistry) closeIdle(now time.Time) {
+	idleSince := now.Add(-r.idleTimeout)
+	r.mutex.Lock()
+	var idle []string
+	for step, s := range r.steps {
+		if !s.lastWrite.After(idleSince) {
+			idle = append(idle, step)
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, step := range idle {
+		log.Printf("Step %s idle for %s, closing", step, r.idleTimeout)
+		r.closing.Add(1)
+		go func(step string) {
+			defer r.closing.Done()
+			if err := r.closeStep(step, idleSince); err != nil {
+				log.Printf("ERROR: %v", err)
+			}
+		}(step)
+	}
+}
+
+// Steps returns the names of the live steps in sorted order.
+func (r *stepRegistry) Steps() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	steps := make([]string, 0, len(r.steps))
+	for step := range r.steps {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+
+	return steps
+}
+
+// Pending returns the names of the steps that are live or still being closed, in
+// sorted order.
+func (r *stepRegistry) Pending() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	steps := make([]string, 0, len(r.steps)+len(r.closingSteps))
+	for step := range r.steps {
+		steps = append(steps, step)
+	}
+	for step := range r.closingSteps {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+
+	return steps
+}
+
+// Close stops idle checking and concurrently closes every live step, waiting for them
+// and any closes already in flight to complete. It fails if any step could not be
+// closed or was closed without a checkpoint.
+func (r *stepRegistry) Close() error {
+	close(r.done)
+
+	var failedMutex sync.Mutex
+	var failed []string
+	for _, step := range r.Steps() {
+		r.closing.Add(1)
+		go func(step string) {
+			defer r.closing.Done()
+			if err := r.CloseStep(step); err != nil {
+				log.Printf("ERROR: %v", err)
+				failedMutex.Lock()
+				failed = append(failed, step)
+				failedMutex.Unlock()
+			}
+		}(step)
+	}
+	r.closing.Wait()
+
+	// A step closed without a checkpoint fails the registry even if it was closed
+	// in the background, so that what is left of it is kept
+	r.mutex.Lock()
+	for step := range r.unfinished {
+		if !contains(failed, step) {
+			failed = append(failed, step)
+		}
+	}
+	r.mutex.Unlock()
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("closing steps %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingStepSavers struct {
+	mutex  sync.Mutex
+	made   []string
+	lines  map[string][]string
+	closed map[string]int
+}
+
+func newRecordingStepSavers() *recordingStepSavers {
+	return &recordingStepSavers{lines: map[string][]string{}, closed: map[string]int{}}
+}
+
+func (r *recordingStepSavers) stepSaver(step string) StepSaver {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.made = append(r.made, step)
+
+	return mockStepSaver{
+		writeLog: func(l *logLine) error {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.lines[step] = append(r.lines[step], l.Message)
+			return nil
+		},
+		close: func() error {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.closed[step]++
+			return nil
+		},
+	}
+}
+
+func TestRegistryInterleavedSteps(t *testing.T) {
+	savers := newRecordingStepSavers()
+	r := newStepRegistry(savers.stepSaver, 0)
+
+	for _, l := range []*logLine{
+		{Time: 1, Message: "a1", Step: "A"},
+		{Time: 2, Message: "b1", Step: "B"},
+		{Time: 3, Message: "a2", Step: "A"},
+		{Time: 4, Message: "c1", Step: "C"},
+		{Time: 5, Message: "b2", Step: "B"},
+	} {
+		if err := r.WriteLog(l); err != nil {
+			t.Fatalf("Unexpected error writing %v: %v", l, err)
+		}
+	}
+
+	if !reflect.DeepEqual(savers.made, []string{"A", "B", "C"}) {
+		t.Errorf("StepSavers made for %v, want [A B C]", savers.made)
+	}
+	if !reflect.DeepEqual(r.Steps(), []string{"A", "B", "C"}) {
+		t.Errorf("Live steps = %v, want [A B C]", r.Steps())
+	}
+	if !reflect.DeepEqual(savers.lines["A"], []string{"a1", "a2"}) {
+		t.Errorf("Lines for A = %v, want [a1 a2]", savers.lines["A"])
+	}
+	if !reflect.DeepEqual(savers.lines["B"], []string{"b1", "b2"}) {
+		t.Errorf("Lines for B = %v, want [b1 b2]", savers.lines["B"])
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Unexpected error closing the registry: %v", err)
+	}
+	for _, step := range []string{"A", "B", "C"} {
+		if savers.closed[step] != 1 {
+			t.Errorf("Step %s closed %d times, want 1", step, savers.closed[step])
+		}
+	}
+}
+
+func TestRegistryCloseStep(t *testing.T) {
+	savers := newRecordingStepSavers()
+	r := newStepRegistry(savers.stepSaver, 0)
+
+	r.WriteLog(&logLine{Time: 1, Message: "a1", Step: "A"})
+	if err := r.CloseStep("A"); err != nil {
+		t.Fatalf("Unexpected error closing step A: %v", err)
+	}
+	if savers.closed["A"] != 1 {
+		t.Errorf("Step A closed %d times, want 1", savers.closed["A"])
+	}
+	if len(r.Steps()) != 0 {
+		t.Errorf("Live steps = %v, want none", r.Steps())
+	}
+
+	r.WriteLog(&logLine{Time: 2, Message: "a2", Step: "A"})
+	if !reflect.DeepEqual(savers.made, []string{"A", "A"}) {
+		t.Errorf("StepSavers made for %v, want [A A]", savers.made)
+	}
+
+	if err := r.CloseStep("missing"); err != nil {
+		t.Errorf("Closing an unknown step should be a no-op. Got %v", err)
+	}
+	r.Close()
+}
+
+func TestRegistryCloseIdle(t *testing.T) {
+	savers := newRecordingStepSavers()
+	r := newStepRegistry(savers.stepSaver, 0)
+	r.idleTimeout = time.Minute
+
+	r.WriteLog(&logLine{Time: 1, Message: "a1", Step: "A"})
+	r.WriteLog(&logLine{Time: 2, Message: "b1", Step: "B"})
+	r.mutex.Lock()
+	r.steps["A"].lastWrite = time.Now().Add(-2 * time.Minute)
+	r.mutex.Unlock()
+
+	r.closeIdle(time.Now())
+	r.closing.Wait()
+
+	if savers.closed["A"] != 1 {
+		t.Errorf("Idle step A closed %d times, want 1", savers.closed["A"])
+	}
+	if savers.closed["B"] != 0 {
+		t.Errorf("Active step B closed %d times, want 0", savers.closed["B"])
+	}
+	if !reflect.DeepEqual(r.Steps(), []string{"B"}) {
+		t.Errorf("Live steps = %v, want [B]", r.Steps())
+	}
+	r.Close()
+}
+
+func TestRegistrySequentialSteps(t *testing.T) {
+	savers := newRecordingStepSavers()
+	r := newStepRegistry(savers.stepSaver, 0)
+	r.sequential = true
+
+	r.WriteLog(&logLine{Time: 1, Message: "a1", Step: "A"})
+	r.WriteLog(&logLine{Time: 2, Message: "a2", Step: "A"})
+	r.WriteLog(&logLine{Time: 3, Message: "b1", Step: "B"})
+	// Step A is closed in the background
+	r.closing.Wait()
+
+	if savers.closed["A"] != 1 {
+		t.Errorf("Step A closed %d times once step B started, want 1", savers.closed["A"])
+	}
+	if got := r.Steps(); !reflect.DeepEqual(got, []string{"B"}) {
+		t.Errorf("Live steps = %v, want [B]", got)
+	}
+	r.Close()
+}
+
+// uncheckpointedStepSaver is a resumableStepSaver that cannot tell where it left off.
+type uncheckpointedStepSaver struct {
+	mockStepSaver
+}
+
+func (uncheckpointedStepSaver) Checkpoint() (stepCheckpoint, bool) {
+	return stepCheckpoint{}, false
+}
+
+func (uncheckpointedStepSaver) Resume(cp stepCheckpoint) error {
+	return nil
+}
+
+func TestRegistryCloseWithoutCheckpoint(t *testing.T) {
+	r := newStepRegistry(func(step string) StepSaver {
+		return uncheckpointedStepSaver{}
+	}, 0)
+	r.sequential = true
+
+	r.WriteLog(&logLine{Time: 1, Message: "a1", Step: "A"})
+	r.WriteLog(&logLine{Time: 2, Message: "b1", Step: "B"})
+	r.closing.Wait()
+
+	if _, ok := r.checkpoints["A"]; ok {
+		t.Errorf("Recorded a checkpoint for step A, which could not take one")
+	}
+	if err := r.Close(); err == nil || !strings.Contains(err.Error(), "A") {
+		t.Errorf("Close() = %v, want an error naming step A", err)
+	}
+}
+
+func TestRegistryIdleCloseSkipsWrittenStep(t *testing.T) {
+	savers := newRecordingStepSavers()
+	r := newStepRegistry(savers.stepSaver, 0)
+	r.idleTimeout = time.Minute
+
+	r.WriteLog(&logLine{Time: 1, Message: "a1", Step: "A"})
+	idleSince := time.Now()
+	// A line arrives after the step was found to be idle but before it is closed
+	r.WriteLog(&logLine{Time: 2, Message: "a2", Step: "A"})
+
+	if err := r.closeStep("A", idleSince); err != nil {
+		t.Fatalf("Unexpected error closing step A: %v", err)
+	}
+	if savers.closed["A"] != 0 {
+		t.Errorf("Step A was closed although it was written to after going idle")
+	}
+	r.Close()
+}
+
+func TestRegistryIdleTimeout(t *testing.T) {
+	savers := newRecordingStepSavers()
+	r := newStepRegistry(savers.stepSaver, 50*time.Millisecond)
+	defer r.Close()
+
+	r.WriteLog(&logLine{Time: 1, Message: "a1", Step: "A"})
+	time.Sleep(200 * time.Millisecond)
+
+	savers.mutex.Lock()
+	closed := savers.closed["A"]
+	savers.mutex.Unlock()
+	if closed != 1 {
+		t.Errorf("Idle step A closed %d times, want 1", closed)
+	}
+}
+
+func TestRegistryCloseErrors(t *testing.T) {
+	r := newStepRegistry(func(step string) StepSaver {
+		return mockStepSaver{close: func() error {
+			if step == "bad" {
+				return errors.New("upload failed")
+			}
+			return nil
+		}}
+	}, 0)
+
+	r.WriteLog(&logLine{Time: 1, Message: "ok", Step: "good"})
+	r.WriteLog(&logLine{Time: 2, Message: "not ok", Step: "bad"})
+
+	err := r.Close()
+	if err == nil || err.Error() != "closing steps bad" {
+		t.Errorf("Close() = %v, want closing steps bad", err)
+	}
+}
+
+func TestRegistryResumesReappearingStep(t *testing.T) {
+	var mutex sync.Mutex
+	uploads := map[string]string{}
+	uploader := &mockSDUploader{
+		upload: func(storePath string, localFile string) error {
+			contents, err := ioutil.ReadFile(localFile)
+			if err != nil {
+				t.Fatalf("Couldn't read uploaded file: %v", err)
+			}
+			mutex.Lock()
+			uploads[storePath] = string(contents)
+			mutex.Unlock()
+			return nil
+		},
+	}
+	stepLines := map[string]int{}
+	screwdriverAPI := MockAPI{
+		updateStepLines: func(stepName string, lineCount int) error {
+			mutex.Lock()
+			stepLines[stepName] = lineCount
+			mutex.Unlock()
+			return nil
+		},
+	}
+	r := newStepRegistry(func(step string) StepSaver {
+		return NewStepSaver(step, uploader, defaultLinesPerFile, screwdriverAPI, "/tmp", stepOptions{})
+	}, 0)
+
+	r.WriteLog(&logLine{Time: 1, Message: "a1", Step: "A"})
+	r.CloseStep("A")
+	r.WriteLog(&logLine{Time: 2, Message: "b1", Step: "B"})
+	r.WriteLog(&logLine{Time: 3, Message: "a2", Step: "A"})
+	if err := r.Close(); err != nil {
+		t.Fatalf("Unexpected error closing the registry: %v", err)
+	}
+
+	wantA := `{"t":1,"m":"a1","n":0,"s":"A"}` + "\n" + `{"t":3,"m":"a2","n":1,"s":"A"}` + "\n"
+	if uploads["A/log.0"] != wantA {
+		t.Errorf("A/log.0 = %q, want %q", uploads["A/log.0"], wantA)
+	}
+	if stepLines["A"] != 2 {
+		t.Errorf("Step lines for A = %d, want 2", stepLines["A"])
+	}
+	if stepLines["B"] != 1 {
+		t.Errorf("Step lines for B = %d, want 1", stepLines["B"])
+	}
+}
@@ -8,20 +8,28 @@ import (
 	"path"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/screwdriver-cd/log-service/screwdriver"
 	"github.com/screwdriver-cd/log-service/sduploader"
 )
 
-// logLine is a representation of log lines coming from the Screwdriver launcher
+// logLine is a representation of log lines coming from the Screwdriver launcher.
+// Emitters that know which stream a line was printed to send it as well, and the
+// other fields they send can be kept as labels.
 type logLine struct {
-	Time    int64  `json:"t"`
-	Message string `json:"m"`
-	Step    string `json:"s"`
+	Time    int64             `json:"t"`
+	Message string            `json:"m"`
+	Step    string            `json:"s"`
+	Stream  string            `json:"stream,omitempty"`
+	Labels  map[string]string `json:"-"`
 }
 
 // String stringifies the logLine for humans to read.
 func (l *logLine) String() string {
+	if len(l.Stream) != 0 {
+		return fmt.Sprintf("{t:%d, m:\"%s\", s:\"%s\", stream:\"%s\"}", l.Time, l.Message, l.Step, l.Stream)
+	}
 	return fmt.Sprintf("{t:%d, m:\"%s\", s:\"%s\"}", l.Time, l.Message, l.Step)
 }
 
@@ -32,27 +40,121 @@ type StepSaver interface {
 	Write(p []byte) (int, error)
 }
 
+// stepCheckpoint records where a closed step left off, so that a StepSaver started
+// later for the same step continues its line numbers and chunks instead of
+// overwriting them.
+type stepCheckpoint struct {
+	lineCount int
+	chunks    []chunkInfo    // uploaded chunks, as listed in the manifest
+	tail      []byte         // contents of the last chunk when it is not full
+	cutoff    *cutoffJournal // last lines kept by a step that reached a quota, if it was not closed
+	findings  []credentialFinding
+}
+
+// stepOptions holds the optional behaviour shared by the StepSavers of a build.
+type stepOptions struct {
+	manifest bool          // upload a manifest.json describing the log files of each step
+	secrets  *secretMasker // mask known secrets in messages
+
+	detector       *credentialDetector // look for likely credentials in messages
+	uploadFindings bool                // upload what the detector found for each step
+
+	spool *spool   // keep log files and a journal on disk to recover from a restart
+	tail  *tailHub // stream stored lines to live tail clients
+
+	ansi string // how to handle ANSI escape sequences in messages
+
+	collapseRedraws bool // store only the final state of lines redrawn with carriage returns
+	redrawSample    int  // also store every redrawSample-th intermediate state
+
+	maxLineSize int  // truncate messages longer than this many bytes; maxLineSize if 0
+	fullLines   bool // upload lines that are truncated in full as objects of their own
+
+	events *eventRules // tag the lines of multi-line events such as stack traces
+	levels bool        // detect the level of each line
+
+	labels *labelPolicy // which labels of the emitter records to store
+
+	stepMaxLines int       // lines stored for a step before only its last lines are kept; 0 for no limit
+	stepMaxBytes int64     // bytes stored for a step before only its last lines are kept; 0 for no limit
+	buildQuota   *logQuota // limits shared by every step of the build
+	quotaTail    int       // how many of the last lines to keep once a quota is reached
+}
+
 type stepSaver struct {
-	StepName       string
-	Uploader       sduploader.SDUploader
-	ScrewdriverAPI screwdriver.API
-	lineCount      int
-	savedLineCount int
-	logFiles       []*logFile
-	encoder        *json.Encoder
-	ticker         *time.Ticker
-	mutex          sync.Mutex
-	linesPerFile   int
-	logFolder      string
+	StepName        string
+	Uploader        sduploader.SDUploader
+	ScrewdriverAPI  screwdriver.API
+	lineCount       int
+	savedLineCount  int
+	logFiles        []*logFile
+	encoder         *json.Encoder
+	ticker          *time.Ticker
+	mutex           sync.Mutex
+	linesPerFile    int
+	logFolder       string
+	checkpoint      stepCheckpoint
+	checkpointed    bool
+	options         stepOptions
+	lineTime        int64
+	manifestMutex   sync.Mutex
+	savedManifest   []byte
+	manifestFinal   bool
+	writeMutex      sync.Mutex
+	redactor        *lineRedactor
+	scanner         *credentialScanner
+	ansi            *ansiFilter
+	redraws         *redrawCollapser
+	grouper         *eventGrouper
+	event           *eventTag // the multi-line event being written
+	levels          lineCounts
+	streams         lineCounts
+	storedBytes     int64
+	quota           *logQuota
+	cutoff          *logCutoff // set once the step reaches a quota
+	journalMutex    sync.Mutex
+	journalClosed   bool
+	fullLineUploads sync.WaitGroup
+	fullLineSlots   chan struct{}
 }
 
 // Close cancels the save ticker, saves the logs for this step, and closes the logFiles.
-// If it gets an error while closing, it stops immediately and returns the error.
+// Where the step left off is checkpointed even if storing its last lines or saving
+// fails, so that a step that reappears continues after what was written. If no
+// checkpoint can be taken, the logFiles are left on disk.
 func (s *stepSaver) Close() error {
 	s.ticker.Stop()
-	err := s.Save()
+
+	cutoff, err := s.finish()
+
+	cp, cpErr := s.takeCheckpoint()
+	if cpErr != nil {
+		for _, f := range s.logFiles {
+			f.Release()
+		}
+		if err != nil {
+			return fmt.Errorf("%v; checkpointing on stepSaver Close: %v", err, cpErr)
+		}
+		return fmt.Errorf("checkpointing on stepSaver Close: %v", cpErr)
+	}
+	s.checkpoint = cp
+	s.checkpointed = true
+	defer func() {
+		for _, f := range s.logFiles {
+			f.Close()
+		}
+	}()
+
+	s.fullLineUploads.Wait()
+
+	if s.options.spool != nil {
+		if err := s.saveJournal(true); err != nil {
+			return fmt.Errorf("journaling on stepSaver Close: %v", err)
+		}
+	}
+
 	if err != nil {
-		return fmt.Errorf("saving on stepSaver Close: %v", err)
+		return err
 	}
 
 	for _, f := range s.logFiles {
@@ -62,6 +164,28 @@ func (s *stepSaver) Close() error {
 	}
 
 	log.Println("Completed step processing for", s.StepName)
+	if len(s.levels) > 0 {
+		log.Printf("Lines by level in step %s: %s", s.StepName, s.levels)
+	}
+	if len(s.streams) > 0 {
+		log.Printf("Lines by stream in step %s: %s", s.StepName, s.streams)
+	}
+	if s.redactor != nil && s.redactor.count > 0 {
+		log.Printf("Masked %d secrets in step %s", s.redactor.count, s.StepName)
+	}
+	if s.scanner != nil && len(s.scanner.findings) > 0 {
+		log.Printf("Found %d likely credentials in step %s", len(s.scanner.findings), s.StepName)
+		if s.options.uploadFindings {
+			if err := s.saveFindings(); err != nil {
+				log.Println("ERROR saving findings:", err)
+			}
+		}
+	}
+
+	if s.StepName == unknownStep {
+		// Screwdriver has no such step to update
+		return nil
+	}
 
 	if err = s.ScrewdriverAPI.UpdateStepLines(s.StepName, s.lineCount); err != nil {
 		return fmt.Errorf("Updating step meta lines: %v", err)
@@ -69,35 +193,299 @@ func (s *stepSaver) Close() error {
 
 	log.Println("Set step lines to", s.lineCount)
 
+	if cutoff != nil {
+		log.Printf("Dropped %d lines (%d bytes) of step %s after the %s was reached", cutoff.DroppedLines, cutoff.DroppedBytes, s.StepName, cutoff.Quota)
+		// The marker line in the log is the record of the cutoff, so reporting it is
+		// best-effort
+		if err := s.ScrewdriverAPI.UpdateStepCutoff(s.StepName, *cutoff); err != nil {
+			log.Printf("WARNING: reporting the log cutoff of step %s: %v", s.StepName, err)
+		}
+	}
+
+	return nil
+}
+
+// Checkpoint returns where the step left off when the stepSaver was closed, and
+// whether a checkpoint could be taken.
+func (s *stepSaver) Checkpoint() (stepCheckpoint, bool) {
+	return s.checkpoint, s.checkpointed
+}
+
+// finish writes out the lines held back so far and saves the logs for the last time,
+// returning the cutoff to report if the step reached a quota. It stops at the first
+// error.
+func (s *stepSaver) finish() (*screwdriver.LogCutoff, error) {
+	if err := s.flush(); err != nil {
+		return nil, fmt.Errorf("flushing on stepSaver Close: %v", err)
+	}
+	cutoff, err := s.releaseCutoff()
+	if err != nil {
+		return nil, fmt.Errorf("storing the last lines on stepSaver Close: %v", err)
+	}
+
+	if err := s.save(true); err != nil {
+		return nil, fmt.Errorf("saving on stepSaver Close: %v", err)
+	}
+
+	return cutoff, nil
+}
+
+// takeCheckpoint returns where the step is, including what is in its last log file
+// when that is not full.
+func (s *stepSaver) takeCheckpoint() (stepCheckpoint, error) {
+	cp := stepCheckpoint{lineCount: s.lineCount, chunks: s.chunks(true)}
+	if s.scanner != nil {
+		cp.findings = s.scanner.findings
+	}
+	if files := s.LogFiles(); s.lineCount%s.linesPerFile != 0 && len(files) > 0 {
+		tail, err := files[len(files)-1].Contents()
+		if err != nil {
+			return cp, fmt.Errorf("reading last log file for step %s: %v", s.StepName, err)
+		}
+		cp.tail = tail
+	}
+
+	return cp, nil
+}
+
+// Resume continues a step from a checkpoint taken when an earlier stepSaver for the
+// same step was closed. It must be called before any lines are written.
+func (s *stepSaver) Resume(cp stepCheckpoint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	saved := func(i int) chunkInfo {
+		for _, c := range cp.chunks {
+			if c.Index == i {
+				return c
+			}
+		}
+		return chunkInfo{Index: i}
+	}
+
+	full := cp.lineCount / s.linesPerFile
+	for i := 0; i < full; i++ {
+		s.logFiles = append(s.logFiles, uploadedLogFile(path.Join(s.StepName, fmt.Sprintf("log.%d", i)), saved(i)))
+	}
+
+	if len(cp.tail) > 0 {
+		destination := path.Join(s.StepName, fmt.Sprintf("log.%d", full))
+		lf, err := s.createLogFile(destination)
+		if err != nil {
+			return fmt.Errorf("resuming log #%d for step %s: %v", full, s.StepName, err)
+		}
+		if err := lf.restore(cp.tail, saved(full), full*s.linesPerFile); err != nil {
+			lf.Close()
+			return fmt.Errorf("resuming log #%d for step %s: %v", full, s.StepName, err)
+		}
+		s.logFiles = append(s.logFiles, lf)
+	}
+
+	s.lineCount = cp.lineCount
+	s.savedLineCount = cp.lineCount
+	for _, c := range cp.chunks {
+		s.storedBytes += c.Size
+	}
+	s.quota.Add(cp.lineCount, s.storedBytes)
+	if cp.cutoff != nil {
+		s.cutoff = cp.cutoff.Restore(s.options.quotaTail)
+	}
+	if s.scanner != nil {
+		// findings.json is replaced when the step is closed again, so it has to
+		// include what was found before
+		s.scanner.findings = append([]credentialFinding{}, cp.findings...)
+	}
+	log.Printf("Resuming step %s at line %d", s.StepName, cp.lineCount)
+
 	return nil
 }
 
 // WriteLog takes a logLine, converts it for storage, and uploads to the SD Store with its uploader.
 // It splits logs into pieces and uploads them separately and incrementally.
 func (s *stepSaver) WriteLog(l *logLine) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if s.redraws == nil {
+		return s.redact(l)
+	}
+
+	for _, line := range s.redraws.Collapse(l) {
+		if err := s.redact(line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// redact writes a line once any secrets in it have been masked.
+func (s *stepSaver) redact(l *logLine) error {
+	if s.redactor == nil {
+		return s.group(l)
+	}
+
+	return s.writeLines(s.redactor.Redact(l))
+}
+
+// group writes a line once it is known whether it is part of a multi-line event.
+func (s *stepSaver) group(l *logLine) error {
+	if s.grouper == nil {
+		return s.store(l, eventNone)
+	}
+
+	return s.writeGrouped(s.grouper.Group(l))
+}
+
+// flush writes out any line that is being held back by the processing in WriteLog.
+func (s *stepSaver) flush() error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if s.redactor != nil {
+		if err := s.writeLines(s.redactor.Flush()); err != nil {
+			return err
+		}
+	}
+	if s.grouper != nil {
+		return s.writeGrouped(s.grouper.Flush())
+	}
+
+	return nil
+}
+
+// flushStale writes out the lines that have been held back by the processing in
+// WriteLog for too long as of now, leaving the others to wait for the lines they may
+// belong with.
+func (s *stepSaver) flushStale(now time.Time) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if s.redactor != nil {
+		if err := s.writeLines(s.redactor.FlushStale(now.Add(-maxSecretHold))); err != nil {
+			return err
+		}
+	}
+	if s.grouper != nil {
+		return s.writeGrouped(s.grouper.FlushStale(now.Add(-groupingWindow)))
+	}
+
+	return nil
+}
+
+// writeLines groups and writes each of lines in order.
+func (s *stepSaver) writeLines(lines []*logLine) error {
+	for _, line := range lines {
+		if err := s.group(line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeGrouped writes each of lines in order, with their role in an event.
+func (s *stepSaver) writeGrouped(lines []groupedLine) error {
+	for _, g := range lines {
+		if err := s.store(g.line, g.role); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeLine converts a processed logLine for storage and writes it to the logFiles,
+// tagging it if it is part of a multi-line event.
+func (s *stepSaver) writeLine(l *logLine, role int) error {
+	message := l.Message
+	if s.scanner != nil {
+		message = s.scanner.Scan(s.lineCount, l)
+	}
+	var spans []ansiSpan
+	if s.ansi != nil {
+		message, spans = s.ansi.Process(message)
+	}
+
 	storedLine := storedLogLine{
 		Time:     l.Time,
-		Message:  l.Message,
+		Message:  message,
 		Line:     s.lineCount,
 		StepName: l.Step,
+		Spans:    spans,
+		Stream:   l.Stream,
+	}
+	s.lineTime = l.Time
+
+	if len(l.Stream) != 0 {
+		s.streams = s.streams.add(l.Stream)
+	}
+	if s.options.labels != nil && len(l.Labels) != 0 {
+		storedLine.Labels = s.labels(l)
+	}
+	if s.options.levels {
+		storedLine.Level = levelOf(message)
+		if len(storedLine.Level) == 0 && l.Stream == streamStderr {
+			// Whatever a tool prints to stderr deserves a closer look
+			storedLine.Level = levelWarn
+		}
+		if len(storedLine.Level) != 0 {
+			s.levels = s.levels.add(storedLine.Level)
+		}
+	}
+
+	switch {
+	case role == eventHead || role == eventContinuation && s.event == nil:
+		s.event = &eventTag{ID: s.lineCount}
+		storedLine.Event = &eventTag{ID: s.lineCount}
+	case role == eventContinuation:
+		s.event.Seq++
+		storedLine.Event = &eventTag{ID: s.event.ID, Seq: s.event.Seq}
+	default:
+		s.event = nil
 	}
 
-	if len(storedLine.Message) > maxLineSize {
+	if limit := s.lineLimit(); len(storedLine.Message) > limit {
+		linesTruncated.Inc(s.StepName)
+		if s.options.fullLines {
+			storedLine.Full = s.saveFullLine(storedLine)
+		}
+
+		// Kept escape sequences must not be cut in half
+		cut := clipEscapes(message, truncateIndex(message, limit))
 		var buffer bytes.Buffer
-		buffer.WriteString(storedLine.Message[:maxLineSize])
-		buffer.WriteString(fmt.Sprintf(" [line truncated after %d characters]", maxLineSize))
+		buffer.WriteString(storedLine.Message[:cut])
+		buffer.WriteString(fmt.Sprintf(" [line truncated after %d characters]", limit))
 		storedLine.Message = buffer.String()
+		storedLine.Spans = clipSpans(storedLine.Spans, utf8.RuneCountInString(message[:cut]))
 	}
 	if err := s.encoder.Encode(storedLine); err != nil {
 		return fmt.Errorf("marshaling log line %v: %v", storedLine, err)
 	}
+	if s.options.tail != nil {
+		s.options.tail.Publish(storedLine)
+	}
 
 	return nil
 }
 
+// createLogFile makes a logFile for a chunk of the step, in the spool if there is one.
+func (s *stepSaver) createLogFile(storePath string) (*logFile, error) {
+	if s.options.spool == nil {
+		return newLogFile(s.Uploader, s.logFolder, storePath)
+	}
+
+	file, err := s.options.spool.createFile(s.StepName, path.Base(storePath))
+	if err != nil {
+		return &logFile{}, fmt.Errorf("creating spool file for %s: %v", storePath, err)
+	}
+
+	return openLogFile(s.Uploader, file, storePath), nil
+}
+
 // newLogFile is a helper for adding a logFile to the internal collection of logFiles.
 func (s *stepSaver) newLogFile(fileName string) error {
-	lf, err := newLogFile(s.Uploader, s.logFolder, fileName)
+	lf, err := s.createLogFile(fileName)
 	if err != nil {
 		return err
 	}
@@ -144,15 +532,26 @@ func (s *stepSaver) Write(p []byte) (int, error) {
 		}
 	}
 
-	n, err := s.LogFiles()[fileNum].Write(p)
+	lf := s.LogFiles()[fileNum]
+	n, err := lf.Write(p)
+	s.storedBytes += int64(n)
+	bytesStored.Add(float64(n), s.StepName)
 	if err != nil {
-		err = fmt.Errorf("writing to log #%d for step %s: %v", fileNum, s.StepName, err)
+		return n, fmt.Errorf("writing to log #%d for step %s: %v", fileNum, s.StepName, err)
 	}
-	return n, err
+	lf.record(s.lineCount, s.lineTime)
+
+	return n, nil
 }
 
 // Save concurrently saves all logFiles, waiting for them all to complete.
 func (s *stepSaver) Save() error {
+	return s.save(false)
+}
+
+// save saves all logFiles and then the manifest, if enabled. A final save marks every
+// chunk in the manifest as complete.
+func (s *stepSaver) save(final bool) error {
 	var wg sync.WaitGroup
 	for _, f := range s.LogFiles() {
 		wg.Add(1)
@@ -167,17 +566,47 @@ func (s *stepSaver) Save() error {
 	}
 
 	wg.Wait()
+
+	if s.options.spool != nil {
+		if err := s.saveJournal(false); err != nil {
+			log.Println("ERROR saving journal:", err)
+		}
+	}
+
+	if s.options.manifest {
+		if err := s.saveManifest(final); err != nil {
+			log.Println("ERROR saving manifest:", err)
+		}
+	}
+
 	return nil
 }
 
 // NewStepSaver creates a StepSaver out of a name and sduploader.SDUploader
-func NewStepSaver(name string, uploader sduploader.SDUploader, linesPerFile int, screwdriverAPI screwdriver.API, logFolder string) StepSaver {
-	s := &stepSaver{StepName: name, Uploader: uploader, ticker: time.NewTicker(uploadInterval), linesPerFile: linesPerFile, ScrewdriverAPI: screwdriverAPI, logFolder: logFolder}
+func NewStepSaver(name string, uploader sduploader.SDUploader, linesPerFile int, screwdriverAPI screwdriver.API, logFolder string, options stepOptions) StepSaver {
+	s := &stepSaver{StepName: name, Uploader: uploader, ticker: time.NewTicker(uploadInterval), linesPerFile: linesPerFile, ScrewdriverAPI: screwdriverAPI, logFolder: logFolder, options: options}
 	e := json.NewEncoder(s)
 	s.encoder = e
+	if options.secrets != nil {
+		s.redactor = &lineRedactor{masker: options.secrets}
+	}
+	if options.detector != nil {
+		s.scanner = &credentialScanner{detector: options.detector}
+	}
+	s.ansi = newANSIFilter(options.ansi)
+	if options.events != nil {
+		s.grouper = &eventGrouper{rules: options.events}
+	}
+	if options.collapseRedraws {
+		s.redraws = &redrawCollapser{sample: options.redrawSample}
+	}
+	s.quota = newLogQuota("step", options.stepMaxLines, options.stepMaxBytes)
 
 	go func(s *stepSaver) {
-		for range s.ticker.C {
+		for now := range s.ticker.C {
+			if err := s.flushStale(now); err != nil {
+				log.Println("Error flushing logs: ", err)
+			}
 			err := s.Save()
 			if err != nil {
 				log.Println("Error saving logs: ", err)
@@ -4,9 +4,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/screwdriver-cd/log-service/screwdriver"
 )
 
 var testStepName = "testStep"
@@ -31,7 +37,8 @@ func mockAPI(t *testing.T, testStepName string) MockAPI {
 }
 
 type MockAPI struct {
-	updateStepLines func(stepName string, lineCount int) error
+	updateStepLines  func(stepName string, lineCount int) error
+	updateStepCutoff func(stepName string, cutoff screwdriver.LogCutoff) error
 }
 
 func (m MockAPI) UpdateStepLines(stepName string, lineCount int) error {
@@ -41,6 +48,13 @@ func (m MockAPI) UpdateStepLines(stepName string, lineCount int) error {
 	return nil
 }
 
+func (m MockAPI) UpdateStepCutoff(stepName string, cutoff screwdriver.LogCutoff) error {
+	if m.updateStepCutoff != nil {
+		return m.updateStepCutoff(stepName, cutoff)
+	}
+	return nil
+}
+
 func newTestStepSaver() *stepSaver {
 	s := &stepSaver{StepName: testStepName, Uploader: &mockSDUploader{}, ScrewdriverAPI: &MockAPI{}, linesPerFile: defaultLinesPerFile, logFolder: "/tmp"}
 	e := json.NewEncoder(s)
@@ -49,6 +63,15 @@ func newTestStepSaver() *stepSaver {
 	return s
 }
 
+// checkpoint returns where a closed stepSaver left off.
+func checkpoint(t *testing.T, s *stepSaver) stepCheckpoint {
+	cp, ok := s.Checkpoint()
+	if !ok {
+		t.Fatalf("No checkpoint for step %s", s.StepName)
+	}
+	return cp
+}
+
 func TestWrite(t *testing.T) {
 	s := newTestStepSaver()
 	if s.lineCount != 0 {
@@ -95,7 +118,7 @@ func TestWrite(t *testing.T) {
 func TestWriteLog(t *testing.T) {
 	s := newTestStepSaver()
 
-	l := &logLine{1234, "TestLine", "step1"}
+	l := &logLine{Time: 1234, Message: "TestLine", Step: "step1"}
 	s.WriteLog(l)
 	if s.lineCount != 1 {
 		t.Errorf("stepSaver.lineCount should be 1. Got %d", s.lineCount)
@@ -109,7 +132,7 @@ func TestWriteLog(t *testing.T) {
 
 	b := bytes.Buffer{}
 	s.encoder = json.NewEncoder(&b)
-	l = &logLine{2345, "TestLine2", "step1"}
+	l = &logLine{Time: 2345, Message: "TestLine2", Step: "step1"}
 	wantLine := `{"t":2345,"m":"TestLine2","n":1,"s":"step1"}` + "\n"
 	s.WriteLog(l)
 	if b.String() != wantLine {
@@ -123,7 +146,7 @@ func TestWriteLogLong(t *testing.T) {
 	s.encoder = json.NewEncoder(&b)
 
 	msg := strings.Repeat("0", maxLineSize)
-	l := &logLine{3456, msg, "step1"}
+	l := &logLine{Time: 3456, Message: msg, Step: "step1"}
 	wantLine := fmt.Sprintf(`{"t":3456,"m":"%s","n":0,"s":"step1"}`, msg) + "\n"
 	s.WriteLog(l)
 	if b.String() != wantLine {
@@ -138,7 +161,7 @@ func TestWriteLogTruncate(t *testing.T) {
 
 	msg := strings.Repeat("0", maxLineSize+1)
 	wantMsg := msg[:5000] + fmt.Sprintf(" [line truncated after %d characters]", maxLineSize)
-	l := &logLine{3456, msg, "step1"}
+	l := &logLine{Time: 3456, Message: msg, Step: "step1"}
 	wantLine := fmt.Sprintf(`{"t":3456,"m":"%s","n":0,"s":"step1"}`, wantMsg) + "\n"
 	s.WriteLog(l)
 	if b.String() != wantLine {
@@ -162,9 +185,9 @@ func TestSaverUploadOnNewFile(t *testing.T) {
 	}
 	screwdriverAPI := mockAPI(t, testStepName)
 
-	s := NewStepSaver(testStepName, uploader, defaultLinesPerFile, screwdriverAPI, "/tmp")
+	s := NewStepSaver(testStepName, uploader, defaultLinesPerFile, screwdriverAPI, "/tmp", stepOptions{})
 	for i := 0; i < defaultLinesPerFile; i++ {
-		l := &logLine{3456, fmt.Sprintf("LogMsg #%d", i), "step1"}
+		l := &logLine{Time: 3456, Message: fmt.Sprintf("LogMsg #%d", i), Step: "step1"}
 		s.WriteLog(l)
 	}
 
@@ -172,7 +195,7 @@ func TestSaverUploadOnNewFile(t *testing.T) {
 		t.Errorf("Unexpected call to Upload(). len(gotUploads) = %d, want 0", len(gotUploads))
 	}
 
-	l := &logLine{3456, fmt.Sprintf("LogMsg #%d", defaultLinesPerFile), "step1"}
+	l := &logLine{Time: 3456, Message: fmt.Sprintf("LogMsg #%d", defaultLinesPerFile), Step: "step1"}
 	s.WriteLog(l)
 
 	// Wait just a moment to let other goroutines do their thing
@@ -206,9 +229,9 @@ func TestSaverUploadOnTimeElapsed(t *testing.T) {
 	screwdriverAPI := mockAPI(t, testStepName)
 
 	gotUploads := []upload{}
-	s := NewStepSaver(testStepName, uploader, defaultLinesPerFile, screwdriverAPI, "/tmp")
+	s := NewStepSaver(testStepName, uploader, defaultLinesPerFile, screwdriverAPI, "/tmp", stepOptions{})
 	for i := 0; i < defaultLinesPerFile; i++ {
-		l := &logLine{3456, fmt.Sprintf("LogMsg #%d", i), "step1"}
+		l := &logLine{Time: 3456, Message: fmt.Sprintf("LogMsg #%d", i), Step: "step1"}
 		s.WriteLog(l)
 		select {
 		case u := <-uploadChan:
@@ -247,8 +270,8 @@ func TestSaverUploadOnClose(t *testing.T) {
 	}
 	screwdriverAPI := mockAPI(t, testStepName)
 
-	s := NewStepSaver(testStepName, uploader, defaultLinesPerFile, screwdriverAPI, "/tmp")
-	l := &logLine{4567, fmt.Sprintf("LogMsg #1"), "step1"}
+	s := NewStepSaver(testStepName, uploader, defaultLinesPerFile, screwdriverAPI, "/tmp", stepOptions{})
+	l := &logLine{Time: 4567, Message: fmt.Sprintf("LogMsg #1"), Step: "step1"}
 	s.WriteLog(l)
 
 	if len(gotUploads) != 0 {
@@ -264,11 +287,186 @@ func TestSaverUploadOnClose(t *testing.T) {
 	}
 }
 
+func TestSaverCloseErrorKeepsFiles(t *testing.T) {
+	uploader := &mockSDUploader{
+		upload: func(storePath string, localFile string) error {
+			return nil
+		},
+	}
+	s := NewStepSaver(testStepName, uploader, defaultLinesPerFile, mockAPI(t, testStepName), "/tmp", stepOptions{}).(*stepSaver)
+	s.WriteLog(&logLine{Time: 4567, Message: "LogMsg #1", Step: "step1"})
+
+	// Reading the last log file back fails once its handle is broken
+	name := s.logFiles[0].file.Name()
+	defer os.Remove(name)
+	s.logFiles[0].file.Close()
+	if err := s.Close(); err == nil {
+		t.Fatalf("Expected an error closing the StepSaver")
+	}
+
+	if _, ok := s.Checkpoint(); ok {
+		t.Errorf("Checkpoint taken without the contents of the last log file")
+	}
+	if s.logFiles[0].file != nil {
+		t.Errorf("Log file left open after an error closing the StepSaver")
+	}
+	if _, err := os.Stat(name); err != nil {
+		t.Errorf("Log file removed although the StepSaver has no checkpoint: %v", err)
+	}
+}
+
+func TestSaverCloseCheckpointsRemovedFile(t *testing.T) {
+	uploads := map[string]string{}
+	uploader := &mockSDUploader{
+		upload: func(storePath string, localFile string) error {
+			contents, err := ioutil.ReadFile(localFile)
+			if err != nil {
+				return err
+			}
+			uploads[storePath] = string(contents)
+			return nil
+		},
+	}
+
+	first := NewStepSaver(testStepName, uploader, defaultLinesPerFile, MockAPI{}, "/tmp", stepOptions{}).(*stepSaver)
+	first.WriteLog(&logLine{Time: 1, Message: "first", Step: testStepName})
+	// The log file can still be read through its handle for the checkpoint
+	os.Remove(first.logFiles[0].file.Name())
+	if err := first.Close(); err != nil {
+		t.Fatalf("Unexpected error closing the first StepSaver: %v", err)
+	}
+
+	second := NewStepSaver(testStepName, uploader, defaultLinesPerFile, MockAPI{}, "/tmp", stepOptions{}).(*stepSaver)
+	if err := second.Resume(checkpoint(t, first)); err != nil {
+		t.Fatalf("Unexpected error resuming: %v", err)
+	}
+	second.WriteLog(&logLine{Time: 2, Message: "second", Step: testStepName})
+	if err := second.Close(); err != nil {
+		t.Fatalf("Unexpected error closing the second StepSaver: %v", err)
+	}
+
+	want := `{"t":1,"m":"first","n":0,"s":"testStep"}` + "\n" +
+		`{"t":2,"m":"second","n":1,"s":"testStep"}` + "\n"
+	if got := uploads[testStepName+"/log.0"]; got != want {
+		t.Errorf("%s/log.0 = %s, want %s", testStepName, got, want)
+	}
+}
+
 func TestLogStringer(t *testing.T) {
-	l := &logLine{123, "TestMSG", "TestStep"}
+	l := &logLine{Time: 123, Message: "TestMSG", Step: "TestStep"}
 	wantString := `{t:123, m:"TestMSG", s:"TestStep"}`
 	if l.String() != wantString {
 		t.Errorf("Bad stringification of logs. Got %s, want %s", l, wantString)
 
 	}
 }
+
+func TestSaverResume(t *testing.T) {
+	var mutex sync.Mutex
+	uploads := map[string]string{}
+	uploader := &mockSDUploader{
+		upload: func(storePath string, localFile string) error {
+			contents, err := ioutil.ReadFile(localFile)
+			if err != nil {
+				t.Fatalf("Couldn't read uploaded file: %v", err)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			uploads[storePath] = string(contents)
+			return nil
+		},
+	}
+	var gotLines []int
+	screwdriverAPI := MockAPI{
+		updateStepLines: func(stepName string, lineCount int) error {
+			gotLines = append(gotLines, lineCount)
+			return nil
+		},
+	}
+
+	first := NewStepSaver(testStepName, uploader, 2, screwdriverAPI, "/tmp", stepOptions{}).(*stepSaver)
+	for i := 0; i < 3; i++ {
+		first.WriteLog(&logLine{Time: int64(i), Message: fmt.Sprintf("first #%d", i), Step: testStepName})
+	}
+	if err := first.Close(); err != nil {
+		t.Fatalf("Unexpected error closing the first StepSaver: %v", err)
+	}
+
+	second := NewStepSaver(testStepName, uploader, 2, screwdriverAPI, "/tmp", stepOptions{}).(*stepSaver)
+	if err := second.Resume(checkpoint(t, first)); err != nil {
+		t.Fatalf("Unexpected error resuming: %v", err)
+	}
+	second.WriteLog(&logLine{Time: 3, Message: "second #0", Step: testStepName})
+	second.WriteLog(&logLine{Time: 4, Message: "second #1", Step: testStepName})
+	if err := second.Close(); err != nil {
+		t.Fatalf("Unexpected error closing the second StepSaver: %v", err)
+	}
+
+	want := map[string]string{
+		testStepName + "/log.0": `{"t":0,"m":"first #0","n":0,"s":"testStep"}` + "\n" +
+			`{"t":1,"m":"first #1","n":1,"s":"testStep"}` + "\n",
+		testStepName + "/log.1": `{"t":2,"m":"first #2","n":2,"s":"testStep"}` + "\n" +
+			`{"t":3,"m":"second #0","n":3,"s":"testStep"}` + "\n",
+		testStepName + "/log.2": `{"t":4,"m":"second #1","n":4,"s":"testStep"}` + "\n",
+	}
+	if !reflect.DeepEqual(uploads, want) {
+		t.Errorf("uploads = %v, want %v", uploads, want)
+	}
+	if !reflect.DeepEqual(gotLines, []int{3, 5}) {
+		t.Errorf("UpdateStepLines called with %v, want [3 5]", gotLines)
+	}
+}
+
+// fakeRangeUploader is an in-memory Store that supports appending to objects.
+type fakeRangeUploader struct {
+	objects   map[string][]byte
+	bytesSent int64
+}
+
+func (f *fakeRangeUploader) Upload(storePath string, localFile string) error {
+	return f.UploadRange(storePath, localFile, 0)
+}
+
+func (f *fakeRangeUploader) UploadRange(storePath string, localFile string, offset int64) error {
+	contents, err := ioutil.ReadFile(localFile)
+	if err != nil {
+		return err
+	}
+	if offset != int64(len(f.objects[storePath])) {
+		return fmt.Errorf("appending %s at %d, object has %d bytes", storePath, offset, len(f.objects[storePath]))
+	}
+
+	f.objects[storePath] = append(f.objects[storePath], contents[offset:]...)
+	f.bytesSent += int64(len(contents)) - offset
+	return nil
+}
+
+func TestSaverUploadsOnlyNewBytes(t *testing.T) {
+	uploader := &fakeRangeUploader{objects: map[string][]byte{}}
+	s := newTestStepSaver()
+	s.Uploader = uploader
+
+	var want bytes.Buffer
+	for i := 0; i < 10; i++ {
+		l := &logLine{Time: int64(i), Message: fmt.Sprintf("LogMsg #%d", i), Step: testStepName}
+		s.WriteLog(l)
+		json.NewEncoder(&want).Encode(storedLogLine{Time: l.Time, Message: l.Message, Line: i, StepName: l.Step})
+		if err := s.Save(); err != nil {
+			t.Fatalf("Unexpected error saving: %v", err)
+		}
+	}
+
+	got := string(uploader.objects[testStepName+"/log.0"])
+	if got != want.String() {
+		t.Errorf("log.0 = %q, want %q", got, want.String())
+	}
+	if uploader.bytesSent != int64(want.Len()) {
+		t.Errorf("Sent %d bytes, want %d", uploader.bytesSent, want.Len())
+	}
+
+	// Saving with no new lines sends nothing
+	s.Save()
+	if uploader.bytesSent != int64(want.Len()) {
+		t.Errorf("Sent %d bytes after an empty save, want %d", uploader.bytesSent, want.Len())
+	}
+}
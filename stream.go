@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Streams a line can be printed to
+const (
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+)
+
+// checkStream returns the stream of a line as it is stored, and an error if the
+// emitter sent a stream we do not know. Lines without a stream are left without one.
+func checkStream(stream string) (string, error) {
+	switch s := strings.ToLower(stream); s {
+	case "", streamStdout, streamStderr:
+		return s, nil
+	}
+
+	return "", fmt.Errorf("unknown stream %q", stream)
+}
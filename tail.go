@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	tailPath = "/v1/tail"
+	// defaultTailHistory is how many recent lines of each step are kept for clients
+	// that resume
+	defaultTailHistory = 1000
+	// tailBuffer is how many lines a client may fall behind before it is disconnected
+	tailBuffer = 256
+	// tailKeepAlive is how often an idle stream sends a comment to keep proxies from
+	// closing it
+	tailKeepAlive = 15 * time.Second
+)
+
+// tailEvent is a stored log line ready to send to live tail clients.
+type tailEvent struct {
+	line   int
+	stream string
+	data   []byte
+}
+
+// tailSubscriber receives the lines of a step as they are stored. Its channel is
+// closed when it falls too far behind or the hub is closed.
+type tailSubscriber struct {
+	step   string
+	events chan tailEvent
+}
+
+// tailHub passes the lines each StepSaver stores on to live tail clients, and keeps
+// the most recent lines of every step so a client that reconnects can resume where
+// it left off.
+type tailHub struct {
+	history     int
+	mutex       sync.Mutex
+	recent      map[string][]tailEvent
+	subscribers map[*tailSubscriber]bool
+	closed      bool
+}
+
+// newTailHub returns a tailHub keeping up to history lines of every step.
+func newTailHub(history int) *tailHub {
+	return &tailHub{
+		history:     history,
+		recent:      map[string][]tailEvent{},
+		subscribers: map[*tailSubscriber]bool{},
+	}
+}
+
+// Publish sends a stored line to the clients tailing its step.
+func (h *tailHub) Publish(l storedLogLine) {
+	data, err := json.Marshal(l)
+	if err != nil {
+		log.Printf("ERROR: marshaling line %d of step %s for live tail: %v", l.Line, l.StepName, err)
+		return
+	}
+	e := tailEvent{line: l.Line, stream: l.Stream, data: data}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.closed {
+		return
+	}
+
+	if h.history > 0 {
+		recent := append(h.recent[l.StepName], e)
+		if len(recent) > h.history {
+			recent = recent[len(recent)-h.history:]
+		}
+		h.recent[l.StepName] = recent
+	}
+
+	for sub := range h.subscribers {
+		if sub.step != l.StepName {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			// The client can reconnect and resume from the last line it got
+			log.Printf("WARNING: live tail client of step %s fell behind, disconnecting it", sub.step)
+			h.unsubscribe(sub)
+		}
+	}
+}
+
+// Subscribe starts following a step from line from, returning the kept lines from
+// that line on and the subscriber that receives the lines after them. If lines after
+// from are no longer kept, missed is the number of lines that cannot be sent.
+func (h *tailHub) Subscribe(step string, from int) (backlog []tailEvent, missed int, sub *tailSubscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	sub = &tailSubscriber{step: step, events: make(chan tailEvent, tailBuffer)}
+	if h.closed {
+		close(sub.events)
+		return nil, 0, sub
+	}
+	h.subscribers[sub] = true
+
+	recent := h.recent[step]
+	if len(recent) > 0 && recent[0].line > from {
+		missed = recent[0].line - from
+	}
+	for i, e := range recent {
+		if e.line >= from {
+			backlog = append(backlog, recent[i:]...)
+			break
+		}
+	}
+
+	return backlog, missed, sub
+}
+
+// Unsubscribe stops sending lines to a subscriber.
+func (h *tailHub) Unsubscribe(sub *tailSubscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.unsubscribe(sub)
+}
+
+// unsubscribe is Unsubscribe for callers that hold the mutex.
+func (h *tailHub) unsubscribe(sub *tailSubscriber) {
+	if h.subscribers[sub] {
+		delete(h.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// Close ends every live tail.
+func (h *tailHub) Close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.closed = true
+	for sub := range h.subscribers {
+		h.unsubscribe(sub)
+	}
+}
+
+// Closed returns whether the hub has been closed.
+func (h *tailHub) Closed() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.closed
+}
+
+// handleTail streams the lines of a step as Server-Sent Events, each with its line
+// number as the event id. The stream starts at the from query parameter, after the
+// Last-Event-ID of a reconnecting client, or with the kept lines of the step. The
+// stream query parameter limits it to the lines printed to stdout or stderr.
+func (s *ingestServer) handleTail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		respond(w, http.StatusMethodNotAllowed, ingestResponse{Error: "only GET is supported"})
+		return
+	}
+
+	if !s.authorized(r) {
+		respond(w, http.StatusUnauthorized, ingestResponse{Error: "missing or bad token"})
+		return
+	}
+
+	step := r.URL.Query().Get("step")
+	if len(step) == 0 {
+		respond(w, http.StatusBadRequest, ingestResponse{Error: "no step to tail"})
+		return
+	}
+
+	from := 0
+	if last := r.Header.Get("Last-Event-ID"); len(last) != 0 {
+		n, err := strconv.Atoi(last)
+		if err != nil || n < 0 {
+			respond(w, http.StatusBadRequest, ingestResponse{Error: fmt.Sprintf("bad Last-Event-ID %q", last)})
+			return
+		}
+		from = n + 1
+	} else if f := r.URL.Query().Get("from"); len(f) != 0 {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			respond(w, http.StatusBadRequest, ingestResponse{Error: fmt.Sprintf("bad from line %q", f)})
+			return
+		}
+		from = n
+	}
+
+	stream, err := checkStream(r.URL.Query().Get("stream"))
+	if err != nil {
+		respond(w, http.StatusBadRequest, ingestResponse{Error: err.Error()})
+		return
+	}
+	wanted := func(e tailEvent) bool {
+		return e.line >= from && (len(stream) == 0 || e.stream == stream)
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respond(w, http.StatusInternalServerError, ingestResponse{Error: "streaming is not supported"})
+		return
+	}
+
+	backlog, missed, sub := s.tail.Subscribe(step, from)
+	defer s.tail.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if missed > 0 {
+		fmt.Fprintf(w, "event: missed\ndata: %d\n\n", missed)
+	}
+	for _, e := range backlog {
+		if wanted(e) {
+			writeTailEvent(w, e)
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(tailKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				if s.tail.Closed() {
+					fmt.Fprint(w, "event: end\ndata: \n\n")
+					flusher.Flush()
+				}
+				return
+			}
+			if wanted(e) {
+				writeTailEvent(w, e)
+			}
+			// Send whatever else is waiting along with it
+			for n := len(sub.events); n > 0; n-- {
+				if e, ok := <-sub.events; ok && wanted(e) {
+					writeTailEvent(w, e)
+				}
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeTailEvent writes a line as a Server-Sent Event.
+func writeTailEvent(w http.ResponseWriter, e tailEvent) {
+	fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.line, e.data)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func publishLines(h *tailHub, step string, from, to int) {
+	for n := from; n < to; n++ {
+		h.Publish(storedLogLine{Time: int64(n), Message: fmt.Sprint("line ", n), Line: n, StepName: step})
+	}
+}
+
+func eventLines(events []tailEvent) []int {
+	var lines []int
+	for _, e := range events {
+		lines = append(lines, e.line)
+	}
+	return lines
+}
+
+func TestTailHubHistory(t *testing.T) {
+	h := newTailHub(3)
+	publishLines(h, "main", 0, 5)
+
+	backlog, missed, _ := h.Subscribe("main", 0)
+	if got := eventLines(backlog); !reflect.DeepEqual(got, []int{2, 3, 4}) || missed != 2 {
+		t.Errorf("Got lines %v missing %d from line 0, want [2 3 4] missing 2", got, missed)
+	}
+
+	backlog, missed, sub := h.Subscribe("main", 4)
+	if got := eventLines(backlog); !reflect.DeepEqual(got, []int{4}) || missed != 0 {
+		t.Errorf("Got lines %v missing %d from line 4, want [4] missing 0", got, missed)
+	}
+
+	backlog, _, other := h.Subscribe("other", 0)
+	if len(backlog) != 0 {
+		t.Errorf("Got lines %v for a step with no lines", eventLines(backlog))
+	}
+
+	publishLines(h, "main", 5, 6)
+	if e := <-sub.events; e.line != 5 || string(e.data) != `{"t":5,"m":"line 5","n":5,"s":"main"}` {
+		t.Errorf("Got line %d %s, want line 5", e.line, e.data)
+	}
+	if len(other.events) != 0 {
+		t.Errorf("A subscriber got a line of another step")
+	}
+
+	h.Close()
+	if _, ok := <-sub.events; ok {
+		t.Errorf("Subscribers should be ended when the hub is closed")
+	}
+}
+
+func TestTailHubSlowSubscriber(t *testing.T) {
+	h := newTailHub(0)
+	_, _, sub := h.Subscribe("main", 0)
+
+	publishLines(h, "main", 0, tailBuffer+1)
+
+	n := 0
+	for range sub.events {
+		n++
+	}
+	if n != tailBuffer {
+		t.Errorf("Got %d lines before being disconnected, want %d", n, tailBuffer)
+	}
+}
+
+func TestTailRejectsBadRequests(t *testing.T) {
+	s := &ingestServer{token: "sharedtoken", tail: newTailHub(10)}
+
+	tests := []struct {
+		method string
+		target string
+		token  string
+		header string
+		want   int
+	}{
+		{http.MethodPost, tailPath + "?step=main", "sharedtoken", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, tailPath + "?step=main", "wrong", "", http.StatusUnauthorized},
+		{http.MethodGet, tailPath, "sharedtoken", "", http.StatusBadRequest},
+		{http.MethodGet, tailPath + "?step=main&from=-1", "sharedtoken", "", http.StatusBadRequest},
+		{http.MethodGet, tailPath + "?step=main", "sharedtoken", "abc", http.StatusBadRequest},
+		{http.MethodGet, tailPath + "?step=main&stream=tty", "sharedtoken", "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		if len(tt.header) != 0 {
+			req.Header.Set("Last-Event-ID", tt.header)
+		}
+		w := httptest.NewRecorder()
+		s.handleTail(w, req)
+
+		if w.Code != tt.want {
+			t.Errorf("%s %s with token %q got status %d, want %d", tt.method, tt.target, tt.token, w.Code, tt.want)
+		}
+	}
+}
+
+func TestTailServer(t *testing.T) {
+	q, _ := newLineQueue(10, overflowBlock, os.TempDir())
+	h := newTailHub(10)
+	publishLines(h, "main", 0, 3)
+
+	s, err := newIngestServer("127.0.0.1:0", "sharedtoken", q, h)
+	if err != nil {
+		t.Fatalf("Unexpected error from newIngestServer: %v", err)
+	}
+	go s.Serve()
+	defer s.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+s.Addr().String()+tailPath+"?step=main", nil)
+	req.Header.Set("Authorization", "Bearer sharedtoken")
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error tailing: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Got status %d with content type %q, want an event stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Unexpected error reading event: %v", err)
+			}
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	want := []string{
+		"id: 1\ndata: {\"t\":1,\"m\":\"line 1\",\"n\":1,\"s\":\"main\"}\n",
+		"id: 2\ndata: {\"t\":2,\"m\":\"line 2\",\"n\":2,\"s\":\"main\"}\n",
+		"id: 3\ndata: {\"t\":3,\"m\":\"line 3\",\"n\":3,\"s\":\"main\"}\n",
+		"event: end\ndata: \n",
+	}
+	for i, w := range want {
+		if i == 2 {
+			publishLines(h, "main", 3, 4)
+		}
+		if i == 3 {
+			go s.Close()
+		}
+		if got := readEvent(); got != w {
+			t.Errorf("Event %d = %q, want %q", i, got, w)
+		}
+	}
+}
+
+func TestTailStreamFilter(t *testing.T) {
+	h := newTailHub(10)
+	h.Publish(storedLogLine{Time: 1, Message: "out", Line: 0, StepName: "main", Stream: streamStdout})
+	h.Publish(storedLogLine{Time: 2, Message: "err", Line: 1, StepName: "main", Stream: streamStderr})
+	h.Publish(storedLogLine{Time: 3, Message: "none", Line: 2, StepName: "main"})
+
+	s := &ingestServer{token: "sharedtoken", tail: h}
+	req := httptest.NewRequest(http.MethodGet, tailPath+"?step=main&stream=stderr", nil)
+	req.Header.Set("Authorization", "Bearer sharedtoken")
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		s.handleTail(w, req)
+		close(done)
+	}()
+
+	// End the stream once the handler has its backlog
+	for subscribed := false; !subscribed; time.Sleep(time.Millisecond) {
+		h.mutex.Lock()
+		subscribed = len(h.subscribers) > 0
+		h.mutex.Unlock()
+	}
+	h.Close()
+	<-done
+
+	want := "id: 1\ndata: {\"t\":2,\"m\":\"err\",\"n\":1,\"s\":\"main\",\"stream\":\"stderr\"}\n\nevent: end\ndata: \n\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestSaverPublishesToTail(t *testing.T) {
+	h := newTailHub(10)
+	s := NewStepSaver(testStepName, &mockSDUploader{}, defaultLinesPerFile, MockAPI{}, "/tmp", stepOptions{tail: h})
+
+	s.WriteLog(&logLine{Time: 1, Message: "first", Step: testStepName})
+	s.WriteLog(&logLine{Time: 2, Message: "second", Step: testStepName})
+	if err := s.Close(); err != nil {
+		t.Fatalf("Unexpected error closing the StepSaver: %v", err)
+	}
+
+	backlog, _, _ := h.Subscribe(testStepName, 0)
+	if got := eventLines(backlog); !reflect.DeepEqual(got, []int{0, 1}) {
+		t.Fatalf("Got lines %v, want [0 1]", got)
+	}
+	if want := `{"t":2,"m":"second","n":1,"s":"` + testStepName + `"}`; string(backlog[1].data) != want {
+		t.Errorf("Got %s, want %s", backlog[1].data, want)
+	}
+}